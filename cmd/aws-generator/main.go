@@ -5,9 +5,10 @@ import (
 	_ "embed"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"go/format"
 	"net/http"
 	"os"
-	"os/exec"
 	"regexp"
 	"sort"
 	"strconv"
@@ -64,13 +65,14 @@ func main() {
 				city = matches[2]
 			}
 
-			lat, long := cityToLatitudeLongitude(city)
+			lat, long, found := cityToLatitudeLongitude(city)
 			locations = append(locations, provision.Location{
-				Latitude:  lat,
-				Longitude: long,
-				Country:   country,
-				City:      city,
-				Key:       region,
+				Latitude:           lat,
+				Longitude:          long,
+				Country:            country,
+				City:               city,
+				Key:                region,
+				CoordinatesUnknown: !found,
 			})
 		}
 
@@ -78,6 +80,16 @@ func main() {
 			return locations[i].Key < locations[j].Key
 		})
 
+		var missing []string
+		for _, loc := range locations {
+			if loc.CoordinatesUnknown {
+				missing = append(missing, loc.Key+" ("+loc.City+")")
+			}
+		}
+		if len(missing) > 0 {
+			fmt.Fprintf(os.Stderr, "warning: no coordinates found for regions: %s\n", strings.Join(missing, ", "))
+		}
+
 		err := writeToFile(outFile, genCode(map[string]any{
 			"Locations": locations,
 		}))
@@ -87,7 +99,7 @@ func main() {
 	}
 }
 
-func cityToLatitudeLongitude(city string) (float64, float64) {
+func cityToLatitudeLongitude(city string) (float64, float64, bool) {
 	lines := bytes.Split(worldCitiesData, []byte("\n"))
 	for _, line := range lines {
 		// "city","city_ascii","lat","lng","country","iso2","iso3","admin_name","capital","population","id"
@@ -109,7 +121,7 @@ func cityToLatitudeLongitude(city string) (float64, float64) {
 				}
 				return f
 			}
-			return parseFloat(string(columns[latitudeColumn])), parseFloat(string(columns[longitudeColumn]))
+			return parseFloat(string(columns[latitudeColumn])), parseFloat(string(columns[longitudeColumn])), true
 		}
 
 		if strings.EqualFold(strings.Trim(string(columns[countryColumn]), "\""), city) {
@@ -120,11 +132,11 @@ func cityToLatitudeLongitude(city string) (float64, float64) {
 				}
 				return f
 			}
-			return parseFloat(string(columns[latitudeColumn])), parseFloat(string(columns[longitudeColumn]))
+			return parseFloat(string(columns[latitudeColumn])), parseFloat(string(columns[longitudeColumn])), true
 		}
 	}
 
-	return 0, 0
+	return 0, 0, false
 }
 
 func genCode(args map[string]any) string {
@@ -142,6 +154,9 @@ func genCode(args map[string]any) string {
 			Country:    "{{ $value.Country }}",
 			City:      "{{ $value.City }}",
 			Key:       "{{ $value.Key }}",
+			{{- if $value.CoordinatesUnknown }}
+			CoordinatesUnknown: true,
+			{{- end }}
 		},
 		{{- end }}
 	}
@@ -176,13 +191,9 @@ func writeToFile(filename, content string) error {
 }
 
 func formatCode(code []byte) []byte {
-	cmd := exec.Command("gofmt")
-	cmd.Stdin = bytes.NewReader(code)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
+	out, err := format.Source(code)
 	if err != nil {
 		panic(err)
 	}
-	return out.Bytes()
+	return out
 }
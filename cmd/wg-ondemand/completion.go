@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/schidstorm/wg-ondemand/pkg/hetzner"
+	"github.com/schidstorm/wg-ondemand/pkg/provision"
+	"github.com/spf13/cobra"
+)
+
+var provisionerTypes = []string{"aws", "hetzner"}
+
+func completionCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:       "completion [bash|zsh|fish|powershell]",
+		Short:     "Generate the shell completion script",
+		Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+		ValidArgs: []string{"bash", "zsh", "fish", "powershell"},
+	}
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		root := cmd.Root()
+		switch args[0] {
+		case "bash":
+			return root.GenBashCompletionV2(os.Stdout, true)
+		case "zsh":
+			return root.GenZshCompletion(os.Stdout)
+		case "fish":
+			return root.GenFishCompletion(os.Stdout, true)
+		default:
+			return root.GenPowerShellCompletionWithDesc(os.Stdout)
+		}
+	}
+
+	return cmd
+}
+
+// registerFlagCompletions adds dynamic completion for the --type and --region flags
+// of cmd and all its nested subcommands that have them.
+func registerFlagCompletions(cmd *cobra.Command) {
+	if cmd.Flags().Lookup("type") != nil {
+		cmd.RegisterFlagCompletionFunc("type", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return provisionerTypes, cobra.ShellCompDirectiveNoFileComp
+		})
+	}
+
+	if cmd.Flags().Lookup("region") != nil {
+		cmd.RegisterFlagCompletionFunc("region", completeRegion)
+	}
+
+	for _, subCmd := range cmd.Commands() {
+		registerFlagCompletions(subCmd)
+	}
+}
+
+func completeRegion(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	provisionerType, _ := cmd.Flags().GetString("type")
+	provisioner, err := createAndInitProvisioner(provisionerType)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	locations, err := provisioner.Locations(ctx)
+	if err == nil {
+		writeCachedLocations(provisionerType, locations)
+	} else {
+		locations = readCachedLocations(provisionerType)
+	}
+
+	if locations == nil && provisionerType == "hetzner" {
+		locations = hetzner.KnownLocations
+	}
+
+	var completions []string
+	for _, loc := range locations {
+		completions = append(completions, loc.Key+"\t"+loc.City+", "+loc.Country)
+	}
+
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
+
+func locationsCacheFile(provisionerType string) (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(cacheDir, "wg-ondemand", provisionerType+"-locations.json"), nil
+}
+
+// writeCachedLocations remembers the locations of a successful live fetch for
+// completion when the provider can not be queried. Failures are ignored.
+func writeCachedLocations(provisionerType string, locations []provision.Location) {
+	path, err := locationsCacheFile(provisionerType)
+	if err != nil {
+		return
+	}
+
+	content, err := json.Marshal(locations)
+	if err != nil {
+		return
+	}
+
+	if os.MkdirAll(filepath.Dir(path), 0700) == nil {
+		os.WriteFile(path, content, 0600)
+	}
+}
+
+func readCachedLocations(provisionerType string) []provision.Location {
+	path, err := locationsCacheFile(provisionerType)
+	if err != nil {
+		return nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var locations []provision.Location
+	if json.Unmarshal(content, &locations) != nil {
+		return nil
+	}
+
+	return locations
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// clientPeerConfig is the [Peer] section of the client config for the deployed server.
+func clientPeerConfig(id, serverPublicKey, allowedIps, endpoint string) string {
+	return fmt.Sprintf(`# id: %s
+[Peer]
+PublicKey = %s
+AllowedIPs = %s
+Endpoint = %s
+`, id, serverPublicKey, allowedIps, endpoint)
+}
+
+// clientInterface are the [Interface] options of the client config, except for the
+// private key which never leaves the client.
+type clientInterface struct {
+	// Address holds the tunnel addresses with the prefix length of the tunnel subnet.
+	Address string
+	// DNS, FwMark, Table and MTU are only written if set.
+	DNS    string
+	FwMark string
+	Table  string
+	MTU    int
+}
+
+// optionLines returns the options that are set as config lines.
+func (c clientInterface) optionLines() []string {
+	lines := []string{"Address = " + c.Address}
+	if c.DNS != "" {
+		lines = append(lines, "DNS = "+c.DNS)
+	}
+	if c.FwMark != "" {
+		lines = append(lines, "FwMark = "+c.FwMark)
+	}
+	if c.Table != "" {
+		lines = append(lines, "Table = "+c.Table)
+	}
+	if c.MTU != 0 {
+		lines = append(lines, "MTU = "+strconv.Itoa(c.MTU))
+	}
+	return lines
+}
+
+// interfaceSection is the printed [Interface] section, to be merged with the one holding
+// the private key.
+func (c clientInterface) interfaceSection() string {
+	return "[Interface]\n" + strings.Join(c.optionLines(), "\n") + "\n\n"
+}
+
+// interfaceAddress is ip with the prefix length of subnet, the form Address expects.
+func interfaceAddress(ip, subnet string) (string, error) {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return "", err
+	}
+
+	ones, _ := ipNet.Mask.Size()
+	return fmt.Sprintf("%s/%d", ip, ones), nil
+}
+
+// clientConfigFile is a complete wg-quick config. The private key has to be filled in
+// before the config can be used.
+func clientConfigFile(iface clientInterface, peerConfig string) string {
+	var config strings.Builder
+	config.WriteString("[Interface]\n")
+	config.WriteString("PrivateKey = <private key of the client>\n")
+	for _, line := range iface.optionLines() {
+		config.WriteString(line + "\n")
+	}
+	config.WriteString("\n")
+	config.WriteString(peerConfig)
+	return config.String()
+}
+
+// domainRegex matches dns names like example.com, a trailing dot is allowed.
+var domainRegex = regexp.MustCompile(`^([a-zA-Z0-9]([-a-zA-Z0-9]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([-a-zA-Z0-9]{0,61}[a-zA-Z0-9])?\.?$`)
+
+// dnsValue builds the value of DNS. wg-quick takes resolvers and search domains on the
+// same line and tells them apart by whether an entry is an ip, so resolvers have to be
+// ips and search domains must not be.
+func dnsValue(servers, searchDomains []string) (string, error) {
+	var entries []string
+	for _, server := range servers {
+		server = strings.TrimSpace(server)
+		if net.ParseIP(server) == nil {
+			return "", fmt.Errorf("invalid dns server %q: expected an ip", server)
+		}
+		entries = append(entries, server)
+	}
+
+	for _, domain := range searchDomains {
+		domain = strings.TrimSpace(domain)
+		if net.ParseIP(domain) != nil || len(domain) > 253 || !domainRegex.MatchString(domain) {
+			return "", fmt.Errorf("invalid dns search domain %q", domain)
+		}
+		entries = append(entries, domain)
+	}
+
+	if len(searchDomains) > 0 && len(servers) == 0 {
+		return "", fmt.Errorf("dns search domains require a dns server")
+	}
+
+	return strings.Join(entries, ", "), nil
+}
+
+// parseFwMark validates a wg fwmark: off, or a 32 bit number in decimal or hex.
+func parseFwMark(s string) (string, error) {
+	if s == "" || s == "off" {
+		return s, nil
+	}
+
+	mark, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return "", fmt.Errorf("invalid fwmark %q: expected off or a 32 bit number", s)
+	}
+	if mark == 0 {
+		return "off", nil
+	}
+
+	return s, nil
+}
+
+// parseRouteTable validates a wg-quick table: off, auto or a routing table number.
+func parseRouteTable(s string) (string, error) {
+	switch s {
+	case "", "off", "auto":
+		return s, nil
+	}
+
+	_, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return "", fmt.Errorf("invalid route table %q: expected off, auto or a number", s)
+	}
+
+	return s, nil
+}
+
+// writeConfigFile writes content readable only by the owner, creating the parent
+// directories. An existing file is only replaced with force.
+func writeConfigFile(path, content string, force bool) error {
+	err := os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	file, err := os.OpenFile(path, flags, 0o600)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%s already exists, use --force to overwrite it", path)
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// an overwritten file keeps its mode otherwise
+	err = file.Chmod(0o600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteString(content)
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
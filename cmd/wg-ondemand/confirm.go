@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/schidstorm/wg-ondemand/pkg/provision"
+)
+
+// isTerminal reports whether f is an interactive terminal rather than a pipe or file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// confirmDeploy prints what is about to be created and asks for confirmation on stderr,
+// so json and yaml output on stdout stays parseable.
+func confirmDeploy(ctx context.Context, provisioner provision.Provisioner, id string, args provision.ProvisionArguments) (bool, error) {
+	estimate, err := provisioner.EstimateCost(ctx, args)
+	if err != nil {
+		log.Warn("Failed to estimate cost", "err", err)
+	}
+
+	orUnknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+
+	region := args.Region
+	if region == "" {
+		region = "default"
+	}
+
+	fmt.Fprintf(os.Stderr, "About to deploy %s\n", id)
+	fmt.Fprintf(os.Stderr, "  provider:       %s\n", args.Type)
+	fmt.Fprintf(os.Stderr, "  region:         %s\n", region)
+	fmt.Fprintf(os.Stderr, "  instance type:  %s\n", orUnknown(estimate.InstanceType))
+	fmt.Fprintf(os.Stderr, "  estimated cost: %s\n", orUnknown(estimate.HourlyCost))
+	fmt.Fprintf(os.Stderr, "  wireguard port: %d\n", args.WgPort)
+	fmt.Fprint(os.Stderr, "Continue? [y/N] ")
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false, err
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
@@ -2,42 +2,133 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/charmbracelet/log"
 	"github.com/schidstorm/wg-ondemand/pkg/aws"
 	"github.com/schidstorm/wg-ondemand/pkg/hetzner"
+	"github.com/schidstorm/wg-ondemand/pkg/metrics"
 	"github.com/schidstorm/wg-ondemand/pkg/provision"
+	"github.com/schidstorm/wg-ondemand/pkg/server"
 	"github.com/spf13/cobra"
 )
 
+const (
+	serverWgIp  = "172.30.0.1"
+	clientWgIp  = "172.30.0.2"
+	wgSubnet    = "172.30.0.0/24"
+	serverWgIp6 = "fd00:30::1"
+	clientWgIp6 = "fd00:30::2"
+	wgSubnet6   = "fd00:30::/64"
+)
+
+// provisionerOptions are global options passed to every provisioner.
+type provisionerOptions struct {
+	Proxy             string
+	VerboseAws        bool
+	SshKeyName        string
+	SshPrivateKeyFile string
+	SshBastion        string
+	SshUser           string
+	SshTimeout        time.Duration
+	SshReadyAttempts  int
+	SshReadyInterval  time.Duration
+	MaxRps            float64
+	RoleSessionName   string
+	ExternalId        string
+	MfaSerial         string
+	MfaToken          string
+	UploadConcurrency int
+	CfnRoleArn        string
+	DeleteConcurrency int
+	RateLimitMaxWait  time.Duration
+}
+
+var options provisionerOptions
+
 func main() {
 	cmd := &cobra.Command{
 		Use: "wg-ondemand",
 		PersistentPreRun: func(cmd *cobra.Command, args []string) {
 			verbose, _ := cmd.Flags().GetBool("verbose")
-			configureLogging(verbose)
+			// only deploy has --quiet
+			quiet, _ := cmd.Flags().GetBool("quiet")
+			configureLogging(verbose || options.VerboseAws, quiet)
+
+			metricsAddr, _ := cmd.Flags().GetString("metrics-addr")
+			if metricsAddr != "" {
+				go func() {
+					err := metrics.Serve(metricsAddr)
+					if err != nil {
+						log.Error("Failed to serve metrics", "err", err)
+					}
+				}()
+			}
 		},
 	}
 
 	cmd.PersistentFlags().BoolP("verbose", "v", false, "Verbose output")
+	cmd.PersistentFlags().BoolVar(&options.VerboseAws, "verbose-aws", false, "Log raw AWS SDK requests and responses (implies --verbose)")
+	cmd.PersistentFlags().StringVar(&options.SshBastion, "ssh-bastion", "", "Hetzner: connect to the server through this jump host, user@host[:port], which has to be in ~/.ssh/known_hosts")
+	cmd.PersistentFlags().StringVar(&options.SshUser, "ssh-user", "root", "Hetzner: user for ssh connections to the server, commands of other users run with passwordless sudo")
+	cmd.PersistentFlags().DurationVar(&options.SshTimeout, "ssh-timeout", 30*time.Second, "Hetzner: timeout for connecting to the server via ssh")
+	cmd.PersistentFlags().IntVar(&options.SshReadyAttempts, "ssh-ready-attempts", 60, "Hetzner: ssh connection attempts while waiting for a new server")
+	cmd.PersistentFlags().DurationVar(&options.SshReadyInterval, "ssh-ready-interval", 5*time.Second, "Hetzner: pause between ssh connection attempts while waiting for a new server")
+	cmd.PersistentFlags().StringVar(&options.SshKeyName, "ssh-key-name", "", "Hetzner: reuse this uploaded ssh key instead of creating one (requires --ssh-private-key-file)")
+	cmd.PersistentFlags().StringVar(&options.SshPrivateKeyFile, "ssh-private-key-file", "", "Hetzner: private key used for ssh connections to the server")
+	cmd.PersistentFlags().DurationVar(&options.RateLimitMaxWait, "rate-limit-max-wait", 2*time.Minute, "Hetzner: how long a rate limited api request waits for the limit to reset (negative disables waiting)")
+	cmd.PersistentFlags().Float64Var(&options.MaxRps, "max-rps", 0, "Limit provider api requests per second (0 means unlimited)")
+	cmd.PersistentFlags().StringVar(&options.RoleSessionName, "role-session-name", "", "AWS: session name when assuming the cdk bootstrap roles")
+	cmd.PersistentFlags().StringVar(&options.ExternalId, "external-id", "", "AWS: external id when assuming the cdk bootstrap roles")
+	cmd.PersistentFlags().StringVar(&options.MfaSerial, "mfa-serial", "", "AWS: mfa device serial or arn for roles requiring mfa")
+	cmd.PersistentFlags().StringVar(&options.MfaToken, "mfa-token", "", "AWS: mfa code, prompted for on stdin if needed and not set")
+	cmd.PersistentFlags().IntVar(&options.UploadConcurrency, "upload-concurrency", 4, "AWS: parts uploaded in parallel per large cdk asset")
+	cmd.PersistentFlags().StringVar(&options.CfnRoleArn, "cfn-role-arn", "", "AWS: service role cloudformation creates the stacks with, has to trust cloudformation.amazonaws.com and needs iam:PassRole")
+	cmd.PersistentFlags().IntVar(&options.DeleteConcurrency, "delete-concurrency", 0, "AWS: deletions running in parallel during delete (0 means all)")
+	cmd.PersistentFlags().String("metrics-addr", "", "Serve prometheus metrics on this address under /metrics, e.g. :9090")
+	cmd.PersistentFlags().StringVar(&options.Proxy, "proxy", "", "Proxy for provider API calls and ssh (http://, https:// or socks5://), defaults to HTTPS_PROXY/ALL_PROXY")
 
 	cmd.AddCommand(provisionCmd())
 	cmd.AddCommand(deProvisionCmd())
 	cmd.AddCommand(regionsCmd())
+	cmd.AddCommand(stopCmd())
+	cmd.AddCommand(startCmd())
+	cmd.AddCommand(usageCmd())
+	cmd.AddCommand(doctorCmd())
+	cmd.AddCommand(serveCmd())
+	cmd.AddCommand(statusCmd())
+	cmd.AddCommand(logsCmd())
+	cmd.AddCommand(bootstrapCmd())
+	cmd.AddCommand(peerCmd())
+	cmd.AddCommand(testInitCmd())
+	cmd.AddCommand(completionCmd())
+	cmd.CompletionOptions.DisableDefaultCmd = true
 
-	err := cmd.Execute()
+	registerFlagCompletions(cmd)
+
+	err := cmd.ExecuteContext(signalContext())
 	if err != nil {
 		panic(err)
 	}
 
 }
 
-func configureLogging(verbose bool) {
+// configureLogging sets up the logger, which writes to stderr. quiet takes precedence
+// over verbose and only keeps errors.
+func configureLogging(verbose, quiet bool) {
 	log.Default().SetTimeFormat("15:04:05")
 	log.Default().SetPrefix("wg-ondemand")
-	if verbose {
+	if quiet {
+		log.Default().SetLevel(log.ErrorLevel)
+	} else if verbose {
 		log.Default().SetLevel(log.DebugLevel)
 	}
 }
@@ -48,51 +139,482 @@ func provisionCmd() *cobra.Command {
 	}
 
 	publicKey := cmd.Flags().StringP("public-key", "k", "", "Client public key")
+	publicKeyFile := cmd.Flags().String("public-key-file", "", "Read the client public key from this file")
 	wgPort := cmd.Flags().Uint16P("port", "p", 51820, "Wireguard port")
-	region := cmd.Flags().StringP("region", "r", "", "AWS region")
+	region := cmd.Flags().StringP("region", "r", "", "Region (aws) or location (hetzner) by key, city or country, e.g. eu-central-1, nbg1 or frankfurt")
 	id := cmd.Flags().StringP("id", "i", "wg-ondemand", "Provision ID")
 	provisionerType := cmd.Flags().StringP("type", "t", "aws", "Provisioner type")
+	provisionMethod := cmd.Flags().String("provision-method", "", "How to run the init script: cloud-init|ssh|ssm (default depends on provisioner)")
+	portRange := cmd.Flags().String("port-range", "", "Open a range of UDP ports start-end in the firewall; wireguard listens on --port, which must be inside the range. Port hopping needs client support")
+	preflight := cmd.Flags().Bool("preflight", false, "Check permissions before creating any resources (AWS: simulates cloudformation:CreateStack and s3:PutObject with iam:SimulatePrincipalPolicy, which needs iam:SimulatePrincipalPolicy and for assumed roles iam:GetRole)")
+	interfaceName := cmd.Flags().String("interface", provision.DefaultInterfaceName, "Name of the wireguard interface on the server")
+	serverPrivateKeyFile := cmd.Flags().String("server-private-key", "", "File with the server wireguard private key, keeps the server public key stable across redeploys. The key is passed in the init script")
+	egressInterface := cmd.Flags().String("egress-interface", "", "Server interface used for NAT, defaults to the interface of the default route")
+	ipv6 := cmd.Flags().Bool("ipv6", false, "Enable dual stack inside the tunnel with ipv6 egress (routed or nat66)")
+	output := cmd.Flags().StringP("output", "o", outputTable, "Output format: table, json or yaml")
+	uniqueId := cmd.Flags().Bool("unique-id", false, "Append a random suffix to --id so concurrent deployments do not collide")
+	instanceType := cmd.Flags().String("instance-type", "", "Instance (aws) or server (hetzner) type, e.g. t4g.nano or cax11; arm types get an arm image (default depends on provisioner)")
+	instanceTypeFallbacks := cmd.Flags().StringSlice("instance-type-fallback", nil, "Hetzner: server types to try in order if --instance-type is unavailable, comma separated")
+	datacenter := cmd.Flags().String("datacenter", "", "Hetzner: create the server in this datacenter, e.g. fsn1-dc14, instead of any datacenter of --region")
+	availabilityZone := cmd.Flags().String("availability-zone", "", "AWS: place the instance in this availability zone of --region, needs a --template declaring AvailabilityZone")
+	amiId := cmd.Flags().String("ami-id", "", "AWS: use this AMI instead of the default image, installation is skipped if wireguard is preinstalled. Needs a --template declaring AmiId")
+	wait := cmd.Flags().Bool("wait", true, "Wait until the init script has finished. With --wait=false the server public key is only available via the status command once ready (requires --provision-method cloud-init, so not supported on aws, where the init script can only be run over ssm by deploy itself)")
+	noCleanupOnFailure := cmd.Flags().Bool("no-cleanup-on-failure", false, "Keep the resources of a failed deploy for debugging, remove them with delete afterwards")
+	onFailure := cmd.Flags().String("on-failure", "", "AWS: what cloudformation does with a failed stack: RETAIN or ROLLBACK keep it for inspection, DELETE (default) removes it")
+	deadline := cmd.Flags().Duration("deadline", 0, "Abort and clean up if provisioning takes longer than this (0 means no deadline)")
+	openPorts := cmd.Flags().StringArray("open-port", nil, "Additional inbound port proto:port[:cidr], cidr defaults to the wireguard subnet (repeatable)")
+	instanceProfileArn := cmd.Flags().String("instance-profile-arn", "", "AWS: attach this existing instance profile, which needs the AmazonSSMManagedInstanceCore policy, instead of creating a role. Needs a --template declaring InstanceProfileArn")
+	templateFile := cmd.Flags().String("template", "", "AWS: cloudformation template file replacing the embedded one, has to declare the WgPort parameter and the InstanceId and ServerIp outputs")
+	endpointOverride := cmd.Flags().String("endpoint-override", "", "Host or ip used as endpoint in the client config instead of the server ip, e.g. a dns name or the address of a nat in front of the server")
+	dnsServers := cmd.Flags().StringSlice("dns", nil, "DNS servers of the client interface, comma separated or repeated")
+	dnsSearch := cmd.Flags().StringSlice("wg-dns-search", nil, "DNS search domains of the client interface, comma separated or repeated (requires --dns)")
+	fwMark := cmd.Flags().String("fwmark", "", "FwMark of the client interface, off or a 32 bit number (hex with 0x), e.g. to avoid routing loops")
+	routeTable := cmd.Flags().String("route-table", "", "Table of the client interface: off, auto or a routing table number")
+	mtu := cmd.Flags().Int("mtu", 0, fmt.Sprintf("MTU of the client and server interface, %d to %d, e.g. for links with a lower mtu (default chosen by wg-quick)", provision.MinMtu, provision.MaxMtu))
+	volumeSize := cmd.Flags().Int("volume-size", 0, "Size in GB of a data volume mounted at "+provision.VolumeMountPath+" on the server (0 means none). Hetzner: at least 10, the volume is kept across redeploys until delete")
+	initScriptAttempts := cmd.Flags().Int("init-script-attempts", 3, "Run the init script this often on the same server before giving up, e.g. on an unavailable package mirror")
+	showServerConfig := cmd.Flags().Bool("show-server-config", false, "Also print the wireguard config of the server, with its private key redacted")
+	configOut := cmd.Flags().String("config-out", "", "Also write the client config to this file with mode 0600, the private key has to be filled in")
+	force := cmd.Flags().Bool("force", false, "Overwrite the --config-out file if it exists")
+	paramFlags := cmd.Flags().StringArray("param", nil, "AWS: additional cloudformation parameter key=value, has to be declared by the template (repeatable)")
+	peerFlags := cmd.Flags().StringArray("peer", nil, "Additional client publickey,ip, the ip has to be inside "+wgSubnet+" (repeatable)")
+	skipBootstrap := cmd.Flags().Bool("skip-bootstrap", false, "AWS: assume the bootstrap stack exists, e.g. created with the bootstrap command by an admin, instead of creating it")
+	forceBootstrap := cmd.Flags().Bool("force-bootstrap", false, "AWS: update the bootstrap stack if it is older than required, it is shared by all deployments of the account and region")
+	lifecycle := cmd.Flags().String("lifecycle", provision.LifecyclePersistent, "ephemeral deployments may be reaped once their ttl is over, persistent ones are never deleted automatically")
+	tagFlags := cmd.Flags().StringArray("tag", nil, "Tag key=value added to all cloud resources, as aws tags or hetzner labels (repeatable)")
+	resultJson := cmd.Flags().Bool("result-json", false, "Print the client config to stderr and a single json result line to stdout for scripts")
+	cmd.Flags().BoolP("quiet", "q", false, "Only log errors, so stdout holds nothing but the client config or the --result-json line")
+	yes := cmd.Flags().BoolP("yes", "y", false, "Do not ask for confirmation, which is only asked when stdin is a terminal")
+	cmd.MarkFlagsMutuallyExclusive("public-key", "public-key-file")
+	cmd.MarkFlagsMutuallyExclusive("output", "result-json")
+	cmd.MarkFlagsMutuallyExclusive("skip-bootstrap", "force-bootstrap")
 
 	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		_, defaultCidr, err := net.ParseCIDR(wgSubnet)
+		if err != nil {
+			return err
+		}
+
+		if *publicKeyFile != "" {
+			*publicKey, err = provision.ReadPublicKeyFile(*publicKeyFile)
+			if err != nil {
+				return err
+			}
+		} else if err := provision.ValidatePublicKey(*publicKey); err != nil {
+			return err
+		}
+
+		var openPortRules []provision.PortRule
+		for _, openPort := range *openPorts {
+			rule, err := provision.ParsePortRule(openPort, *defaultCidr)
+			if err != nil {
+				return err
+			}
+			openPortRules = append(openPortRules, rule)
+		}
+
+		var template string
+		if *templateFile != "" {
+			content, err := os.ReadFile(*templateFile)
+			if err != nil {
+				return err
+			}
+			template = string(content)
+		}
+
+		var iface clientInterface
+		iface.Address, err = interfaceAddress(clientWgIp, wgSubnet)
+		if err != nil {
+			return err
+		}
+		if *ipv6 {
+			address6, err := interfaceAddress(clientWgIp6, wgSubnet6)
+			if err != nil {
+				return err
+			}
+			iface.Address += ", " + address6
+		}
+		iface.DNS, err = dnsValue(*dnsServers, *dnsSearch)
+		if err != nil {
+			return err
+		}
+		iface.FwMark, err = parseFwMark(*fwMark)
+		if err != nil {
+			return err
+		}
+		iface.Table, err = parseRouteTable(*routeTable)
+		if err != nil {
+			return err
+		}
+		if *volumeSize < 0 {
+			return fmt.Errorf("invalid volume size %d", *volumeSize)
+		}
+
+		err = provision.ValidateMtu(*mtu)
+		if err != nil {
+			return err
+		}
+		iface.MTU = *mtu
+
+		if *endpointOverride != "" {
+			err = validateEndpointHost(cmd.Context(), *endpointOverride)
+			if err != nil {
+				return err
+			}
+		}
+
+		// fail before creating anything rather than after
+		if *configOut != "" && !*force {
+			if _, err := os.Stat(*configOut); err == nil {
+				return fmt.Errorf("%s already exists, use --force to overwrite it", *configOut)
+			}
+		}
+
+		stackParameters := map[string]string{}
+		for _, param := range *paramFlags {
+			key, value, ok := strings.Cut(param, "=")
+			if !ok || key == "" {
+				return fmt.Errorf("invalid parameter %q: expected key=value", param)
+			}
+			stackParameters[key] = value
+		}
+
+		var peers []provision.Peer
+		for _, peerFlag := range *peerFlags {
+			peer, err := provision.ParsePeer(peerFlag)
+			if err != nil {
+				return err
+			}
+			if !defaultCidr.Contains(peer.WgIp) {
+				return fmt.Errorf("peer ip %s is not inside %s", peer.WgIp, wgSubnet)
+			}
+			peers = append(peers, peer)
+		}
+
+		tags := map[string]string{}
+		for _, tag := range *tagFlags {
+			key, value, err := provision.ParseTag(tag)
+			if err != nil {
+				return err
+			}
+			if provision.IsReservedTag(key) {
+				return fmt.Errorf("tag %q is reserved", key)
+			}
+			tags[key] = value
+		}
+
+		err = provision.ValidateLifecycle(*lifecycle)
+		if err != nil {
+			return err
+		}
+
+		var serverPrivateKey string
+		if *serverPrivateKeyFile != "" {
+			serverPrivateKey, err = provision.ReadPrivateKeyFile(*serverPrivateKeyFile)
+			if err != nil {
+				return err
+			}
+		}
+
+		var wgPortRange *provision.PortRange
+		if *portRange != "" {
+			r, err := provision.ParsePortRange(*portRange)
+			if err != nil {
+				return err
+			}
+			if !r.Contains(*wgPort) {
+				return fmt.Errorf("port %d is not inside port range %s", *wgPort, r)
+			}
+			wgPortRange = &r
+		}
+
+		if *uniqueId {
+			*id, err = provision.UniqueId(*id)
+			if err != nil {
+				return err
+			}
+			log.Info("Using unique id, pass it to delete and status", "id", *id)
+		}
+
 		provisioner, err := createAndInitProvisioner(*provisionerType)
 		if err != nil {
 			log.Error("Failed to initialize provisioner", "err", err)
 			return err
 		}
 
+		*region, err = resolveRegion(cmd.Context(), provisioner, *region)
+		if err != nil {
+			return err
+		}
+
+		ctx := cmd.Context()
+		if *deadline > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, *deadline)
+			defer cancel()
+		}
+
+		var clientIp6, serverIp6 net.IP
+		if *ipv6 {
+			clientIp6 = net.ParseIP(clientWgIp6)
+			serverIp6 = net.ParseIP(serverWgIp6)
+		}
+
+		provisionArgs := provision.ProvisionArguments{
+			ClientPublicKey:       *publicKey,
+			ClientWgIp:            net.ParseIP(clientWgIp),
+			ServerWgIp:            net.ParseIP(serverWgIp),
+			WgPort:                *wgPort,
+			Type:                  *provisionerType,
+			Region:                *region,
+			ProvisionMethod:       *provisionMethod,
+			OpenPorts:             openPortRules,
+			WgPortRange:           wgPortRange,
+			Preflight:             *preflight,
+			InterfaceName:         *interfaceName,
+			EgressInterface:       *egressInterface,
+			ClientWgIp6:           clientIp6,
+			ServerWgIp6:           serverIp6,
+			ServerPrivateKey:      serverPrivateKey,
+			InstanceType:          *instanceType,
+			InstanceTypeFallbacks: *instanceTypeFallbacks,
+			AmiId:                 *amiId,
+			Datacenter:            *datacenter,
+			AvailabilityZone:      *availabilityZone,
+			InstanceProfileArn:    *instanceProfileArn,
+			NoCleanupOnFailure:    *noCleanupOnFailure,
+			OnFailure:             *onFailure,
+			NoWait:                !*wait,
+			Tags:                  tags,
+			Peers:                 peers,
+			Template:              template,
+			StackParameters:       stackParameters,
+			SkipBootstrap:         *skipBootstrap,
+			ForceBootstrap:        *forceBootstrap,
+			Lifecycle:             *lifecycle,
+			InitScriptAttempts:    *initScriptAttempts,
+			Mtu:                   *mtu,
+			VolumeSize:            *volumeSize,
+		}
+
+		if !*yes && isTerminal(os.Stdin) {
+			confirmed, err := confirmDeploy(ctx, provisioner, *id, provisionArgs)
+			if err != nil {
+				return err
+			}
+			if !confirmed {
+				return errors.New("deploy aborted")
+			}
+		}
+
 		log.Info("Provision", "type", *provisionerType)
-		res, err := provisioner.Provision(context.Background(), *id, provision.ProvisionArguments{
-			ClientPublicKey: *publicKey,
-			ClientWgIp:      net.ParseIP("172.30.0.2"),
-			ServerWgIp:      net.ParseIP("172.30.0.1"),
-			WgPort:          *wgPort,
-			Type:            *provisionerType,
+		res, err := provisioner.Provision(ctx, *id, provisionArgs)
+		if err != nil {
+			log.Error("Failed to provision server", "err", err)
+			return err
+		}
+
+		allowedIps := "0.0.0.0/0"
+		if *ipv6 {
+			allowedIps += ", ::/0"
+		}
+
+		endpoint := net.JoinHostPort(res.ServerIP.String(), strconv.Itoa(int(*wgPort)))
+		serverPublicKey := res.ServerPublicKey
+		if *wait {
+			err = validatePeerConfig(res.ServerPublicKey, allowedIps, endpoint)
+			if err != nil {
+				log.Error("Generated an invalid client config, run delete to remove the server", "err", err)
+				return err
+			}
+		} else {
+			// the partial result has no key until the init script has run
+			serverPublicKey = fmt.Sprintf("<server public key from status --id %s once ready>", *id)
+		}
+		if *endpointOverride != "" {
+			endpoint = net.JoinHostPort(*endpointOverride, strconv.Itoa(int(*wgPort)))
+		}
+
+		peerConfig := clientPeerConfig(*id, serverPublicKey, allowedIps, endpoint)
+		configWriter := os.Stdout
+		if *resultJson {
+			configWriter = os.Stderr
+		}
+
+		var serverConfig string
+		if *showServerConfig {
+			serverConfig = res.ServerConfig
+		}
+
+		err = printOutput(*output, deployOutput{
+			Id:              *id,
+			Provider:        *provisionerType,
 			Region:          *region,
+			ServerIp:        res.ServerIP.String(),
+			ServerWgIp:      res.ServerWgIp.String(),
+			ServerPublicKey: res.ServerPublicKey,
+			Port:            *wgPort,
+			ClientWgIp:      clientWgIp,
+			InterfaceName:   res.InterfaceName,
+			InstanceType:    res.InstanceType,
+			VolumeMountPath: res.VolumeMountPath,
+			ServerConfig:    serverConfig,
+		}, func() {
+			if !*wait {
+				fmt.Fprintf(configWriter, "Server %s created at %s, run status --id %s to get the server public key once it is ready\n", *id, res.ServerIP, *id)
+			}
+			fmt.Fprint(configWriter, "\n"+iface.interfaceSection()+peerConfig)
+			if serverConfig != "" {
+				// commented out, so the output stays a usable client config
+				fmt.Fprintf(configWriter, "\n# server config of %s, private key redacted\n", res.InterfaceName)
+				for _, line := range strings.Split(strings.TrimSuffix(serverConfig, "\n"), "\n") {
+					fmt.Fprintln(configWriter, strings.TrimSpace("# "+line))
+				}
+			}
 		})
 		if err != nil {
-			log.Error("Failed to provision server", "err", err)
 			return err
 		}
 
-		fmt.Printf(`
-[Peer]
-PublicKey = %s
-AllowedIPs = 0.0.0.0/0
-Endpoint = %s:%d
-`, res.ServerPublicKey, res.ServerIP, *wgPort)
+		if *configOut != "" {
+			err = writeConfigFile(*configOut, clientConfigFile(iface, peerConfig), *force)
+			if err != nil {
+				log.Error("Failed to write client config, the server is deployed", "err", err)
+				return err
+			}
+			if *wait {
+				log.Info("Wrote client config, fill in the private key", "path", *configOut)
+			} else {
+				log.Info("Wrote client config, fill in the private key and the server public key once ready", "path", *configOut)
+			}
+		}
 
-		return nil
+		if !*resultJson {
+			return nil
+		}
+
+		return json.NewEncoder(os.Stdout).Encode(resultLine{
+			ServerIp:        res.ServerIP.String(),
+			ServerPublicKey: res.ServerPublicKey,
+			Port:            *wgPort,
+			ClientWgIp:      clientWgIp,
+			Region:          *region,
+			Provider:        *provisionerType,
+		})
 	}
 
 	return cmd
 }
 
+// resolveRegion maps a city or country given as region to the key of the provider. Unknown
+// regions are passed on unchanged, the provider knows best whether they exist.
+func resolveRegion(ctx context.Context, provisioner provision.Provisioner, region string) (string, error) {
+	if region == "" {
+		return "", nil
+	}
+
+	loc, err := provision.ResolveLocation(ctx, provisioner, region)
+	if errors.Is(err, provision.ErrUnknownLocation) {
+		return region, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if loc.Key != region {
+		log.Info("Resolved region", "region", region, "key", loc.Key)
+	}
+	return loc.Key, nil
+}
+
+// validateEndpointHost checks that host is an ip or a name that resolves.
+func validateEndpointHost(ctx context.Context, host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsUnspecified() {
+			return fmt.Errorf("invalid endpoint ip %q", host)
+		}
+		return nil
+	}
+
+	_, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return fmt.Errorf("endpoint host %q does not resolve: %w", host, err)
+	}
+
+	return nil
+}
+
+// validatePeerConfig checks the values of the printed [Peer] section, so a broken
+// deployment fails here instead of silently on the client.
+func validatePeerConfig(publicKey, allowedIps, endpoint string) error {
+	err := provision.ValidatePublicKey(publicKey)
+	if err != nil {
+		return fmt.Errorf("server %w", err)
+	}
+
+	for _, allowedIp := range strings.Split(allowedIps, ",") {
+		_, _, err := net.ParseCIDR(strings.TrimSpace(allowedIp))
+		if err != nil {
+			return fmt.Errorf("invalid allowed ips: %w", err)
+		}
+	}
+
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint: %w", err)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() {
+		return fmt.Errorf("invalid endpoint ip %q", host)
+	}
+
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || portNumber == 0 {
+		return fmt.Errorf("invalid endpoint port %q", port)
+	}
+
+	return nil
+}
+
 func deProvisionCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use: "delete",
 	}
 
-	region := cmd.Flags().StringP("region", "r", "", "AWS region")
+	region := cmd.Flags().StringP("region", "r", "", "Region (aws) or location (hetzner) by key, city or country, e.g. eu-central-1, nbg1 or frankfurt")
+	id := cmd.Flags().StringP("id", "i", "wg-ondemand", "Provision ID")
+	provisionerType := cmd.Flags().StringP("type", "t", "aws", "Provisioner type")
+	removeBootstrap := cmd.Flags().Bool("remove-bootstrap", false, "AWS: also remove the bootstrap stack and its asset bucket, which are shared by all deployments of the account and region")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		provisioner, err := createAndInitProvisioner(*provisionerType)
+		if err != nil {
+			log.Error("Failed to initialize provisioner", "err", err)
+			return err
+		}
+
+		*region, err = resolveRegion(cmd.Context(), provisioner, *region)
+		if err != nil {
+			return err
+		}
+
+		return provisioner.DeProvision(cmd.Context(), *id, provision.DeProvisionArguments{
+			Region:          *region,
+			RemoveBootstrap: *removeBootstrap,
+		})
+	}
+
+	return cmd
+}
+
+func stopCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stop",
+		Short: "Power off the server without deleting it",
+	}
+
+	region := cmd.Flags().StringP("region", "r", "", "Region (aws) or location (hetzner) by key, city or country, e.g. eu-central-1, nbg1 or frankfurt")
 	id := cmd.Flags().StringP("id", "i", "wg-ondemand", "Provision ID")
 	provisionerType := cmd.Flags().StringP("type", "t", "aws", "Provisioner type")
 
@@ -103,7 +625,12 @@ func deProvisionCmd() *cobra.Command {
 			return err
 		}
 
-		return provisioner.DeProvision(context.Background(), *id, provision.DeProvisionArguments{
+		*region, err = resolveRegion(cmd.Context(), provisioner, *region)
+		if err != nil {
+			return err
+		}
+
+		return provisioner.Stop(cmd.Context(), *id, provision.InstanceArguments{
 			Region: *region,
 		})
 	}
@@ -111,11 +638,305 @@ func deProvisionCmd() *cobra.Command {
 	return cmd
 }
 
+func startCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "start",
+		Short: "Power on a stopped server",
+	}
+
+	region := cmd.Flags().StringP("region", "r", "", "Region (aws) or location (hetzner) by key, city or country, e.g. eu-central-1, nbg1 or frankfurt")
+	id := cmd.Flags().StringP("id", "i", "wg-ondemand", "Provision ID")
+	provisionerType := cmd.Flags().StringP("type", "t", "aws", "Provisioner type")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		provisioner, err := createAndInitProvisioner(*provisionerType)
+		if err != nil {
+			log.Error("Failed to initialize provisioner", "err", err)
+			return err
+		}
+
+		*region, err = resolveRegion(cmd.Context(), provisioner, *region)
+		if err != nil {
+			return err
+		}
+
+		return provisioner.Start(cmd.Context(), *id, provision.InstanceArguments{
+			Region: *region,
+		})
+	}
+
+	return cmd
+}
+
+func usageCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "usage",
+		Short: "Show the traffic of a running server",
+	}
+
+	region := cmd.Flags().StringP("region", "r", "", "Region (aws) or location (hetzner) by key, city or country, e.g. eu-central-1, nbg1 or frankfurt")
+	id := cmd.Flags().StringP("id", "i", "wg-ondemand", "Provision ID")
+	provisionerType := cmd.Flags().StringP("type", "t", "aws", "Provisioner type")
+	interfaceName := cmd.Flags().String("interface", provision.DefaultInterfaceName, "Name of the wireguard interface on the server")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		provisioner, err := createAndInitProvisioner(*provisionerType)
+		if err != nil {
+			log.Error("Failed to initialize provisioner", "err", err)
+			return err
+		}
+
+		*region, err = resolveRegion(cmd.Context(), provisioner, *region)
+		if err != nil {
+			return err
+		}
+
+		report, err := provisioner.Usage(cmd.Context(), *id, provision.InstanceArguments{
+			Region:        *region,
+			InterfaceName: *interfaceName,
+		})
+		if err != nil {
+			log.Error("Failed to get usage", "err", err)
+			return err
+		}
+
+		for _, peer := range report.Peers {
+			fmt.Printf("%s: rx %d bytes, tx %d bytes\n", peer.PublicKey, peer.RxBytes, peer.TxBytes)
+		}
+
+		if report.ProviderIngoingBytes != nil && report.ProviderOutgoingBytes != nil {
+			fmt.Printf("provider: in %d bytes, out %d bytes\n", *report.ProviderIngoingBytes, *report.ProviderOutgoingBytes)
+		}
+
+		return nil
+	}
+
+	return cmd
+}
+
+func statusCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show whether the server exists and is ready",
+	}
+
+	region := cmd.Flags().StringP("region", "r", "", "Region (aws) or location (hetzner) by key, city or country, e.g. eu-central-1, nbg1 or frankfurt")
+	id := cmd.Flags().StringP("id", "i", "wg-ondemand", "Provision ID")
+	provisionerType := cmd.Flags().StringP("type", "t", "aws", "Provisioner type")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		provisioner, err := createAndInitProvisioner(*provisionerType)
+		if err != nil {
+			log.Error("Failed to initialize provisioner", "err", err)
+			return err
+		}
+
+		*region, err = resolveRegion(cmd.Context(), provisioner, *region)
+		if err != nil {
+			return err
+		}
+
+		report, err := provisioner.Status(cmd.Context(), *id, provision.InstanceArguments{
+			Region: *region,
+		})
+		if err != nil {
+			log.Error("Failed to get status", "err", err)
+			return err
+		}
+
+		if !report.Exists {
+			fmt.Printf("%s does not exist\n", *id)
+			return nil
+		}
+
+		fmt.Printf("running: %t\nserver ip: %s\nready: %t\n", report.Running, report.ServerIP, report.Ready)
+		if report.Ready {
+			fmt.Printf("server public key: %s\n", report.ServerPublicKey)
+		}
+
+		return nil
+	}
+
+	return cmd
+}
+
+func doctorCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Check credentials and prerequisites",
+	}
+
+	region := cmd.Flags().StringP("region", "r", "", "Region (aws) or location (hetzner) by key, city or country, e.g. eu-central-1, nbg1 or frankfurt")
+	provisionerType := cmd.Flags().StringP("type", "t", "aws", "Provisioner type")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		provisioner, err := createAndInitProvisioner(*provisionerType)
+		if err != nil {
+			log.Error("Failed to initialize provisioner", "err", err)
+			return err
+		}
+
+		*region, err = resolveRegion(cmd.Context(), provisioner, *region)
+		if err != nil {
+			return err
+		}
+
+		failed := 0
+		for _, result := range provisioner.Diagnose(cmd.Context(), provision.InstanceArguments{
+			Region: *region,
+		}) {
+			if result.Err != nil {
+				failed++
+				fmt.Printf("FAIL %s: %s\n", result.Name, result.Err)
+			} else if result.Skipped != "" {
+				fmt.Printf("SKIP %s: %s\n", result.Name, result.Skipped)
+			} else {
+				fmt.Printf("PASS %s\n", result.Name)
+			}
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d checks failed", failed)
+		}
+
+		return nil
+	}
+
+	return cmd
+}
+
+func serveCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve a REST api for deploy, delete and regions",
+	}
+
+	listen := cmd.Flags().StringP("listen", "l", "127.0.0.1:8080", "Listen address")
+	token := cmd.Flags().String("token", os.Getenv("WG_ONDEMAND_TOKEN"), "Bearer token clients have to send, defaults to WG_ONDEMAND_TOKEN")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		srv := &server.Server{
+			Token:          *token,
+			NewProvisioner: createAndInitProvisioner,
+			ServerWgIp:     net.ParseIP(serverWgIp),
+			ClientWgIp:     net.ParseIP(clientWgIp),
+		}
+
+		return srv.ListenAndServe(cmd.Context(), *listen)
+	}
+
+	return cmd
+}
+
 func regionsCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use: "regions",
 	}
 
+	provisionerType := cmd.Flags().StringP("type", "t", "aws", "Provisioner type, all lists the locations of every provider with credentials")
+	near := cmd.Flags().String("near", "", "Sort locations by distance to \"lat,long\"")
+	output := cmd.Flags().StringP("output", "o", outputTable, "Output format: table, json or yaml")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		var locations []provision.Location
+		if *provisionerType == "all" {
+			locations = allLocations(cmd.Context())
+		} else {
+			provisioner, err := createAndInitProvisioner(*provisionerType)
+			if err != nil {
+				log.Error("Failed to initialize provisioner", "err", err)
+				return err
+			}
+
+			locations, err = provisioner.Locations(cmd.Context())
+			if err != nil {
+				log.Error("Failed to get locations", "err", err)
+				return err
+			}
+		}
+
+		if *near != "" {
+			lat, long, err := provision.ParseCoordinates(*near)
+			if err != nil {
+				return err
+			}
+
+			sorted := provision.SortByDistance(locations, lat, long)
+			return printOutput(*output, sorted, func() {
+				for _, loc := range sorted {
+					if loc.CoordinatesUnknown {
+						fmt.Printf("%s: %s, %s (distance unknown)\n", locationKey(loc.Location), loc.City, loc.Country)
+						continue
+					}
+					fmt.Printf("%s: %s, %s (%.0f km)\n", locationKey(loc.Location), loc.City, loc.Country, loc.DistanceKm)
+				}
+			})
+		}
+
+		return printOutput(*output, locations, func() {
+			for _, loc := range locations {
+				fmt.Printf("%s: %s, %s\n", locationKey(loc), loc.City, loc.Country)
+			}
+		})
+	}
+
+	return cmd
+}
+
+// locationKey prefixes the key with the provider if it is set.
+func locationKey(loc provision.Location) string {
+	if loc.Provider == "" {
+		return loc.Key
+	}
+	return loc.Provider + "/" + loc.Key
+}
+
+// allLocations fetches the locations of every provisioner type concurrently. Providers
+// that fail, usually for missing credentials, are skipped with a warning.
+func allLocations(ctx context.Context) []provision.Location {
+	results := make([][]provision.Location, len(provisionerTypes))
+	var tasks []func() error
+	for i, t := range provisionerTypes {
+		tasks = append(tasks, func() error {
+			provisioner, err := createAndInitProvisioner(t)
+			if err != nil {
+				log.Warn("Skipping provider", "type", t, "err", err)
+				return nil
+			}
+
+			locations, err := provisioner.Locations(ctx)
+			if err != nil {
+				log.Warn("Skipping provider", "type", t, "err", err)
+				return nil
+			}
+
+			// copies, the provider may return a shared slice
+			for _, loc := range locations {
+				loc.Provider = provisioner.Name()
+				results[i] = append(results[i], loc)
+			}
+			return nil
+		})
+	}
+
+	// the tasks never fail, they skip their provider instead
+	_ = provision.RunTasks(0, tasks)
+
+	var locations []provision.Location
+	for _, result := range results {
+		locations = append(locations, result...)
+	}
+	return locations
+}
+
+func logsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "logs",
+		Short: "Show the provider logs of a deployment, e.g. after a failed deploy",
+	}
+
+	region := cmd.Flags().StringP("region", "r", "", "Region (aws) or location (hetzner) by key, city or country, e.g. eu-central-1, nbg1 or frankfurt")
+	id := cmd.Flags().StringP("id", "i", "wg-ondemand", "Provision ID")
 	provisionerType := cmd.Flags().StringP("type", "t", "aws", "Provisioner type")
 
 	cmd.RunE = func(cmd *cobra.Command, args []string) error {
@@ -125,14 +946,21 @@ func regionsCmd() *cobra.Command {
 			return err
 		}
 
-		locations, err := provisioner.Locations(context.Background())
+		*region, err = resolveRegion(cmd.Context(), provisioner, *region)
+		if err != nil {
+			return err
+		}
+
+		sections, err := provisioner.Logs(cmd.Context(), *id, provision.InstanceArguments{
+			Region: *region,
+		})
 		if err != nil {
-			log.Error("Failed to get locations", "err", err)
+			log.Error("Failed to get logs", "err", err)
 			return err
 		}
 
-		for _, loc := range locations {
-			fmt.Printf("%s: %s, %s\n", loc.Key, loc.City, loc.Country)
+		for _, section := range sections {
+			fmt.Printf("==> %s <==\n%s\n", section.Title, section.Content)
 		}
 
 		return nil
@@ -141,15 +969,78 @@ func regionsCmd() *cobra.Command {
 	return cmd
 }
 
+func bootstrapCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "bootstrap",
+		Short: "Create the one-time per account and region setup, so deploy can run with --skip-bootstrap and narrower credentials",
+	}
+
+	region := cmd.Flags().StringP("region", "r", "", "Region (aws) or location (hetzner) by key, city or country, e.g. eu-central-1, nbg1 or frankfurt")
+	provisionerType := cmd.Flags().StringP("type", "t", "aws", "Provisioner type")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		provisioner, err := createAndInitProvisioner(*provisionerType)
+		if err != nil {
+			log.Error("Failed to initialize provisioner", "err", err)
+			return err
+		}
+
+		*region, err = resolveRegion(cmd.Context(), provisioner, *region)
+		if err != nil {
+			return err
+		}
+
+		return provisioner.Bootstrap(cmd.Context(), provision.InstanceArguments{
+			Region: *region,
+		})
+	}
+
+	return cmd
+}
+
+// mfaTokenProvider returns token, or prompts for a code on stdin if it is empty.
+func mfaTokenProvider(token string) func() (string, error) {
+	if token != "" {
+		return func() (string, error) {
+			return token, nil
+		}
+	}
+	return stscreds.StdinTokenProvider
+}
+
 func createAndInitProvisioner(t string) (provision.Provisioner, error) {
 	var provisioner provision.Provisioner
 	switch t {
 	case "aws":
-		provisioner = &aws.AwsProvisioner{}
+		provisioner = &aws.AwsProvisioner{
+			Proxy:                  options.Proxy,
+			LogSdkRequests:         options.VerboseAws,
+			MaxRps:                 options.MaxRps,
+			UploadConcurrency:      options.UploadConcurrency,
+			CfnRoleArn:             options.CfnRoleArn,
+			DeProvisionConcurrency: options.DeleteConcurrency,
+			AssumeRole: aws.AssumeRoleOptions{
+				RoleSessionName: options.RoleSessionName,
+				ExternalId:      options.ExternalId,
+				MfaSerial:       options.MfaSerial,
+				TokenProvider:   mfaTokenProvider(options.MfaToken),
+			},
+		}
 	case "hetzner":
-		provisioner = &hetzner.HetznerProvisioner{}
+		provisioner = &hetzner.HetznerProvisioner{
+			Proxy:             options.Proxy,
+			SshKeyName:        options.SshKeyName,
+			SshPrivateKeyFile: options.SshPrivateKeyFile,
+			SshBastion:        options.SshBastion,
+			SshUser:           options.SshUser,
+			SshTimeout:        options.SshTimeout,
+			SshReadyAttempts:  options.SshReadyAttempts,
+			SshReadyInterval:  options.SshReadyInterval,
+			RateLimitMaxWait:  options.RateLimitMaxWait,
+			MaxRps:            options.MaxRps,
+		}
 	default:
-		return nil, fmt.Errorf("unknown provisioner type: %s", t)
+		return nil, fmt.Errorf("unknown provisioner type: %s, expected one of %s", t, strings.Join(provisionerTypes, ", "))
 	}
 
 	return provisioner, nil
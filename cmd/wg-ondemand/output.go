@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	outputTable = "table"
+	outputJson  = "json"
+	outputYaml  = "yaml"
+)
+
+// printOutput prints v as json or yaml, or calls printTable for the human readable default.
+func printOutput(format string, v any, printTable func()) error {
+	switch format {
+	case "", outputTable:
+		printTable()
+		return nil
+	case outputJson:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	case outputYaml:
+		encoder := yaml.NewEncoder(os.Stdout)
+		defer encoder.Close()
+		return encoder.Encode(v)
+	default:
+		return fmt.Errorf("unknown output format %q, expected table, json or yaml", format)
+	}
+}
+
+// deployOutput is the machine readable result of deploy. IPs are strings so they
+// render the same in json and yaml.
+type deployOutput struct {
+	Id              string `json:"id" yaml:"id"`
+	Provider        string `json:"provider" yaml:"provider"`
+	Region          string `json:"region" yaml:"region"`
+	ServerIp        string `json:"serverIp" yaml:"serverIp"`
+	ServerWgIp      string `json:"serverWgIp" yaml:"serverWgIp"`
+	ServerPublicKey string `json:"serverPublicKey" yaml:"serverPublicKey"`
+	Port            uint16 `json:"port" yaml:"port"`
+	ClientWgIp      string `json:"clientWgIp" yaml:"clientWgIp"`
+	InterfaceName   string `json:"interfaceName" yaml:"interfaceName"`
+	InstanceType    string `json:"instanceType,omitempty" yaml:"instanceType,omitempty"`
+	VolumeMountPath string `json:"volumeMountPath,omitempty" yaml:"volumeMountPath,omitempty"`
+	// ServerConfig is only set with --show-server-config.
+	ServerConfig string `json:"serverConfig,omitempty" yaml:"serverConfig,omitempty"`
+}
+
+// resultLine is the single line printed by deploy --result-json.
+type resultLine struct {
+	ServerIp        string `json:"server_ip"`
+	ServerPublicKey string `json:"server_public_key"`
+	Port            uint16 `json:"port"`
+	ClientWgIp      string `json:"client_wg_ip"`
+	Region          string `json:"region"`
+	Provider        string `json:"provider"`
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/charmbracelet/log"
+	"github.com/schidstorm/wg-ondemand/pkg/provision"
+	"github.com/spf13/cobra"
+)
+
+// peerCmd changes the clients of a running server without redeploying it.
+func peerCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "peer",
+		Short: "Add or remove clients of a running server",
+	}
+
+	cmd.AddCommand(peerAddCmd())
+	cmd.AddCommand(peerRemoveCmd())
+
+	return cmd
+}
+
+func peerAddCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "add",
+		Short: "Add a client to a running server",
+	}
+
+	region := cmd.Flags().StringP("region", "r", "", "Region (aws) or location (hetzner) by key, city or country, e.g. eu-central-1, nbg1 or frankfurt")
+	id := cmd.Flags().StringP("id", "i", "wg-ondemand", "Provision ID")
+	provisionerType := cmd.Flags().StringP("type", "t", "aws", "Provisioner type")
+	interfaceName := cmd.Flags().String("interface", provision.DefaultInterfaceName, "Name of the wireguard interface on the server")
+	publicKey := cmd.Flags().StringP("public-key", "k", "", "Public key of the client")
+	ip := cmd.Flags().String("ip", "", "Tunnel ip of the client, has to be inside "+wgSubnet)
+	cmd.MarkFlagRequired("public-key")
+	cmd.MarkFlagRequired("ip")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		peer, err := provision.ParsePeer(*publicKey + "," + *ip)
+		if err != nil {
+			return err
+		}
+
+		if peer.WgIp.String() == serverWgIp {
+			return fmt.Errorf("peer ip %s is the server ip", peer.WgIp)
+		}
+
+		_, subnet, err := net.ParseCIDR(wgSubnet)
+		if err != nil {
+			return err
+		}
+		if !subnet.Contains(peer.WgIp) {
+			return fmt.Errorf("peer ip %s is not inside %s", peer.WgIp, wgSubnet)
+		}
+
+		provisioner, err := createAndInitProvisioner(*provisionerType)
+		if err != nil {
+			log.Error("Failed to initialize provisioner", "err", err)
+			return err
+		}
+
+		*region, err = resolveRegion(cmd.Context(), provisioner, *region)
+		if err != nil {
+			return err
+		}
+
+		return provisioner.AddPeer(cmd.Context(), *id, peer, provision.InstanceArguments{
+			Region:        *region,
+			InterfaceName: *interfaceName,
+		})
+	}
+
+	return cmd
+}
+
+func peerRemoveCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "remove",
+		Short: "Remove a client from a running server",
+	}
+
+	region := cmd.Flags().StringP("region", "r", "", "Region (aws) or location (hetzner) by key, city or country, e.g. eu-central-1, nbg1 or frankfurt")
+	id := cmd.Flags().StringP("id", "i", "wg-ondemand", "Provision ID")
+	provisionerType := cmd.Flags().StringP("type", "t", "aws", "Provisioner type")
+	interfaceName := cmd.Flags().String("interface", provision.DefaultInterfaceName, "Name of the wireguard interface on the server")
+	publicKey := cmd.Flags().StringP("public-key", "k", "", "Public key of the client")
+	cmd.MarkFlagRequired("public-key")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		err := provision.ValidatePublicKey(*publicKey)
+		if err != nil {
+			return err
+		}
+
+		provisioner, err := createAndInitProvisioner(*provisionerType)
+		if err != nil {
+			log.Error("Failed to initialize provisioner", "err", err)
+			return err
+		}
+
+		*region, err = resolveRegion(cmd.Context(), provisioner, *region)
+		if err != nil {
+			return err
+		}
+
+		return provisioner.RemovePeer(cmd.Context(), *id, *publicKey, provision.InstanceArguments{
+			Region:        *region,
+			InterfaceName: *interfaceName,
+		})
+	}
+
+	return cmd
+}
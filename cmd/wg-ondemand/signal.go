@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// shutdownGracePeriod is how long the cleanup of cancelled operations may take after
+// SIGINT or SIGTERM before the process exits anyway.
+const shutdownGracePeriod = 30 * time.Second
+
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM, so a running
+// deploy aborts and removes what it created. A second signal exits immediately.
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		log.Warn("Received signal, cancelling and cleaning up", "signal", sig, "gracePeriod", shutdownGracePeriod)
+		cancel()
+
+		select {
+		case sig = <-signals:
+			log.Error("Received second signal, exiting without cleanup", "signal", sig)
+		case <-time.After(shutdownGracePeriod):
+			log.Error("Cleanup did not finish within the grace period, exiting", "gracePeriod", shutdownGracePeriod)
+		}
+		os.Exit(1)
+	}()
+
+	return ctx
+}
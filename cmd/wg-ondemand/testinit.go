@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/schidstorm/wg-ondemand/pkg/provision"
+	"github.com/spf13/cobra"
+)
+
+// testInitCmd runs the init script in a local systemd container to catch regressions
+// of init.sh without creating cloud resources.
+func testInitCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:    "test-init",
+		Short:  "Run the init script in a local docker container and check its output",
+		Hidden: true,
+	}
+
+	image := cmd.Flags().String("image", "rockylinux/rockylinux:9-ubi-init", "Container image, has to boot systemd with --init-command")
+	initCommand := cmd.Flags().String("init-command", "/sbin/init", "Command starting systemd inside the container")
+	templateType := cmd.Flags().StringP("type", "t", "hetzner", "Provisioner type the init script is rendered for")
+	interfaceName := cmd.Flags().String("interface", provision.DefaultInterfaceName, "Name of the wireguard interface")
+	keep := cmd.Flags().Bool("keep", false, "Keep the container for inspection")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+
+		out, err := exec.CommandContext(ctx, "docker", "run", "--detach", "--privileged", *image, *initCommand).Output()
+		if err != nil {
+			return fmt.Errorf("failed to start container: %w", err)
+		}
+		container := strings.TrimSpace(string(out))
+		log.Info("Started container", "container", container, "image", *image)
+
+		if !*keep {
+			defer func() {
+				err := exec.Command("docker", "rm", "--force", container).Run()
+				if err != nil {
+					log.Error("Failed to remove container", "container", container, "err", err)
+				}
+			}()
+		}
+
+		dockerExec := func(script string) (string, error) {
+			var stdout, stderr bytes.Buffer
+			c := exec.CommandContext(ctx, "docker", "exec", "--interactive", container, "bash", "-s")
+			c.Stdin = strings.NewReader(script)
+			c.Stdout = &stdout
+			c.Stderr = &stderr
+			err := c.Run()
+			if err != nil {
+				return stdout.String(), provision.WithOutput(err, stderr.String())
+			}
+			return stdout.String(), nil
+		}
+
+		// dummy client key, the peer is never connected
+		output, err := provision.ProvisionArguments{
+			ClientPublicKey: "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+			ClientWgIp:      net.ParseIP(clientWgIp),
+			ServerWgIp:      net.ParseIP(serverWgIp),
+			WgPort:          51820,
+			Type:            *templateType,
+			InterfaceName:   *interfaceName,
+		}.RunInitScript(ctx, dockerExec)
+		if err != nil {
+			return err
+		}
+
+		if provision.ValidatePublicKey(output.ServerWgPublicKey) != nil {
+			return fmt.Errorf("init script returned invalid server public key %q", output.ServerWgPublicKey)
+		}
+
+		stdout, err := dockerExec("wg show " + output.InterfaceName + " public-key")
+		if err != nil {
+			return fmt.Errorf("wireguard interface is not up: %w", err)
+		}
+		if strings.TrimSpace(stdout) != output.ServerWgPublicKey {
+			return errors.New("public key of the interface does not match the init script output")
+		}
+
+		log.Info("Init script passed", "wgImplementation", output.WgImplementation, "egressInterface", output.EgressInterface, "interface", output.InterfaceName)
+		return nil
+	}
+
+	return cmd
+}
@@ -5,24 +5,31 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	_ "embed"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
 	cfTypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamTypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/charmbracelet/log"
+	"github.com/schidstorm/wg-ondemand/pkg/metrics"
 	"github.com/schidstorm/wg-ondemand/pkg/provision"
 )
 
@@ -43,11 +50,51 @@ var cdkTemplate string
 var bootstrapTemplate string
 
 type AwsProvisioner struct {
-	cfClient  *cloudformation.Client
+	// Credentials overrides the default credential chain (env, shared config, ...) if set.
+	Credentials aws.CredentialsProvider
+	// Proxy overrides the HTTPS_PROXY environment variable if set.
+	Proxy string
+	// LogSdkRequests logs the raw requests and responses of the AWS SDK at debug level.
+	LogSdkRequests bool
+	// MaxRps limits the api requests per second across all clients, 0 means unlimited.
+	MaxRps float64
+	// AssumeRole customizes the assume role calls into the cdk bootstrap roles.
+	AssumeRole AssumeRoleOptions
+	// DeProvisionConcurrency limits the deletions running in parallel, 0 runs all at once.
+	DeProvisionConcurrency int
+	// CfnRoleArn is the service role cloudformation creates the stacks with instead of
+	// the caller's permissions. Its trust policy has to allow cloudformation.amazonaws.com
+	// to assume it and the caller needs iam:PassRole on it.
+	CfnRoleArn string
+	// UploadConcurrency is the number of parts uploaded in parallel per large cdk asset.
+	// Values below 1 mean 1.
+	UploadConcurrency int
+
+	cfClient  cloudformationClient
 	ssmClient *ssm.Client
 	stsClient *sts.Client
 	s3Client  *s3.Client
 	ec2Client *ec2.Client
+	iamClient *iam.Client
+
+	// credentialsChecked is set once the credentials were probed successfully, the
+	// clients are initialized again for every operation and region.
+	credentialsChecked bool
+}
+
+var roleArnRegex = regexp.MustCompile(`^arn:aws[a-z-]*:iam::\d{12}:role/[\w+=,.@/-]+$`)
+var instanceProfileArnRegex = regexp.MustCompile(`^arn:aws[a-z-]*:iam::\d{12}:instance-profile/[\w+=,.@/-]+$`)
+
+// cloudformationClient is the part of the cloudformation client the provisioner uses,
+// tests replace it with a fake.
+type cloudformationClient interface {
+	CreateStack(ctx context.Context, params *cloudformation.CreateStackInput, optFns ...func(*cloudformation.Options)) (*cloudformation.CreateStackOutput, error)
+	UpdateStack(ctx context.Context, params *cloudformation.UpdateStackInput, optFns ...func(*cloudformation.Options)) (*cloudformation.UpdateStackOutput, error)
+	DeleteStack(ctx context.Context, params *cloudformation.DeleteStackInput, optFns ...func(*cloudformation.Options)) (*cloudformation.DeleteStackOutput, error)
+	DescribeStacks(ctx context.Context, params *cloudformation.DescribeStacksInput, optFns ...func(*cloudformation.Options)) (*cloudformation.DescribeStacksOutput, error)
+	DescribeStackEvents(ctx context.Context, params *cloudformation.DescribeStackEventsInput, optFns ...func(*cloudformation.Options)) (*cloudformation.DescribeStackEventsOutput, error)
+	ValidateTemplate(ctx context.Context, params *cloudformation.ValidateTemplateInput, optFns ...func(*cloudformation.Options)) (*cloudformation.ValidateTemplateOutput, error)
+	Options() cloudformation.Options
 }
 
 type AwsError interface {
@@ -56,36 +103,189 @@ type AwsError interface {
 	Code() string
 }
 
-func (p *AwsProvisioner) Provision(ctx context.Context, id string, args provision.ProvisionArguments) (provision.ProvisionResult, error) {
+func (p *AwsProvisioner) Provision(ctx context.Context, id string, args provision.ProvisionArguments) (_ provision.ProvisionResult, err error) {
+	defer func() {
+		metrics.ObserveOperation("aws", "provision", err)
+	}()
+
 	log.Info("Initialize SDK clients", "region", args.Region)
-	err := p.initSdkClients(ctx, args.Region)
+	err = p.initSdkClients(ctx, args.Region)
+	if err != nil {
+		return provision.ProvisionResult{}, err
+	}
+
+	switch args.ProvisionMethod {
+	case "", provision.ProvisionMethodSsm:
+	default:
+		return provision.ProvisionResult{}, fmt.Errorf("unsupported provision method for aws: %s", args.ProvisionMethod)
+	}
+
+	if args.NoWait {
+		return provision.ProvisionResult{}, errors.New("not waiting is not supported on aws, the init script runs over ssm from deploy and there is no cloud-init provision method")
+	}
+
+	onFailure := cfTypes.OnFailure(strings.ToUpper(args.OnFailure))
+	switch onFailure {
+	case "RETAIN":
+		// cloudformation calls retaining DO_NOTHING
+		onFailure = cfTypes.OnFailureDoNothing
+	case "", cfTypes.OnFailureDelete, cfTypes.OnFailureRollback, cfTypes.OnFailureDoNothing:
+	default:
+		return provision.ProvisionResult{}, fmt.Errorf("invalid on failure %q, expected RETAIN, ROLLBACK or DELETE", args.OnFailure)
+	}
+
+	if p.CfnRoleArn != "" && !roleArnRegex.MatchString(p.CfnRoleArn) {
+		return provision.ProvisionResult{}, fmt.Errorf("invalid cloudformation role arn %q", p.CfnRoleArn)
+	}
+
+	templateBody := cdkTemplate
+	if args.Template != "" {
+		templateBody = args.Template
+	}
+	template, err := parseTemplate(templateBody)
+	if err != nil {
+		return provision.ProvisionResult{}, err
+	}
+	err = template.checkArguments(args)
+	if err != nil {
+		return provision.ProvisionResult{}, err
+	}
+
+	tags := args.ResourceTags()
+	err = validateTags(tags)
 	if err != nil {
 		return provision.ProvisionResult{}, err
 	}
+	stackOpts := stackOptions{
+		OnFailure:     onFailure,
+		KeepOnFailure: args.NoCleanupOnFailure,
+		Tags:          tags,
+		// the template attaches the given profile instead of creating a role
+		NoIam: args.InstanceProfileArn != "",
+	}
+
+	if args.InstanceProfileArn != "" && !instanceProfileArnRegex.MatchString(args.InstanceProfileArn) {
+		return provision.ProvisionResult{}, fmt.Errorf("invalid instance profile arn %q", args.InstanceProfileArn)
+	}
+
+	if args.AvailabilityZone != "" {
+		err = p.validateAvailabilityZone(ctx, args.AvailabilityZone)
+		if err != nil {
+			return provision.ProvisionResult{}, err
+		}
+	}
+
+	// before the bootstrap, so a typo does not leave anything behind
+	var architecture string
+	if args.InstanceType != "" {
+		architecture, err = p.instanceArchitecture(ctx, args.InstanceType)
+		if err != nil {
+			return provision.ProvisionResult{}, err
+		}
+	}
+
+	if args.Preflight {
+		log.Info("Checking permissions")
+		err = p.preflight(ctx, id)
+		if err != nil {
+			return provision.ProvisionResult{}, err
+		}
+	}
 
 	var wgPort = strconv.Itoa(int(args.WgPort))
 
-	log.Info("Provisioning bootstrap stack", "stackName", bootstrapStackName)
-	_, _, err = p.provisionStack(ctx, bootstrapStackName, bootstrapTemplate, map[string]string{})
+	args.ReportProgress("bootstrap")
+	phaseStart := time.Now()
+	if args.SkipBootstrap {
+		err = p.requireBootstrap(ctx)
+		if err == nil {
+			err = p.checkBootstrapVersion(ctx)
+		}
+	} else {
+		err = p.bootstrap(ctx, stackOpts, args.ForceBootstrap)
+	}
+	metrics.ObservePhase("aws", "bootstrap_stack", phaseStart)
 	if err != nil {
 		return provision.ProvisionResult{}, err
 	}
 
-	EmulateCdk(ctx, p.stsClient)
+	args.ReportProgress("upload assets")
+	log.Info("Uploading cdk assets")
+	err = EmulateCdk(ctx, p.stsClient, p.AssumeRole, p.UploadConcurrency)
+	if err != nil {
+		return provision.ProvisionResult{}, err
+	}
 
-	log.Info("Provisioning stack", "stackName", id)
-	stackOutput, stackRemoveHandler, err := p.provisionStack(ctx, id, cdkTemplate, map[string]string{
+	stackParams := map[string]string{
 		"WgPort": wgPort,
-	})
+	}
+	if args.AmiId != "" {
+		stackParams["AmiId"] = args.AmiId
+	}
+	if args.AvailabilityZone != "" {
+		stackParams["AvailabilityZone"] = args.AvailabilityZone
+	}
+	if args.VolumeSize > 0 {
+		// the template attaches an ebs volume of this size in GB
+		stackParams["VolumeSize"] = strconv.Itoa(args.VolumeSize)
+	}
+	if args.InstanceProfileArn != "" {
+		// the template attaches this profile instead of creating a role
+		stackParams["InstanceProfileArn"] = args.InstanceProfileArn
+	}
+	if args.InstanceType != "" {
+		stackParams["InstanceType"] = args.InstanceType
+		// selects the x86_64 or arm64 variant of the default image
+		stackParams["Architecture"] = architecture
+	}
+	if args.WgPortRange != nil {
+		stackParams["WgPortRangeStart"] = strconv.Itoa(int(args.WgPortRange.Start))
+		stackParams["WgPortRangeEnd"] = strconv.Itoa(int(args.WgPortRange.End))
+	}
+	if len(args.OpenPorts) > 0 {
+		var openPorts []string
+		for _, openPort := range args.OpenPorts {
+			openPorts = append(openPorts, openPort.String())
+		}
+		// comma separated list of proto:port:cidr, expanded into security group ingress rules by the template
+		stackParams["ExtraIngressRules"] = strings.Join(openPorts, ",")
+	}
+
+	for key, value := range args.StackParameters {
+		if _, ok := stackParams[key]; ok {
+			return provision.ProvisionResult{}, fmt.Errorf("parameter %s is already set by the deploy arguments", key)
+		}
+		stackParams[key] = value
+	}
+
+	err = template.checkParameters(stackParams)
+	if err != nil {
+		return provision.ProvisionResult{}, err
+	}
+
+	args.ReportProgress("create stack")
+	log.Info("Provisioning stack", "stackName", id)
+	phaseStart = time.Now()
+	stackOutput, stackRemoveHandler, err := p.provisionStack(ctx, id, templateBody, stackParams, stackOpts)
+	metrics.ObservePhase("aws", "stack", phaseStart)
 	if err != nil {
 		return provision.ProvisionResult{}, err
 	}
 	removeHandler := func() {
+		if args.NoCleanupOnFailure {
+			log.Warn("Keeping failed stack, inspect the instance with ssm and remove it with delete",
+				"stackName", id,
+				"ssm", fmt.Sprintf("aws ssm start-session --region %s --target %s", p.ec2Client.Options().Region, stackOutput["InstanceId"]),
+				"initOutput", provision.InitScriptOutputFile)
+			return
+		}
+
 		log.Info("Cleaning up stack", "stackName", id)
 		stackRemoveHandler()
 	}
 
 	instanceId := stackOutput["InstanceId"]
+	args.ReportProgress("wait for instance")
 	log.Info("Waiting for instance to be up", "instanceId", instanceId)
 	err = p.waitUntilUp(ctx, instanceId)
 	if err != nil {
@@ -93,7 +293,15 @@ func (p *AwsProvisioner) Provision(ctx context.Context, id string, args provisio
 		return provision.ProvisionResult{}, err
 	}
 
+	serverIp, err := p.publicIp(ctx, instanceId, stackOutput["ServerIp"])
+	if err != nil {
+		removeHandler()
+		return provision.ProvisionResult{}, err
+	}
+
+	args.ReportProgress("init script")
 	log.Info("Running init script")
+	phaseStart = time.Now()
 	outputParams, err := args.RunInitScript(ctx, func(script string) (string, error) {
 		stdout, stderr, err := p.runShell(ctx, instanceId, script)
 		if err != nil {
@@ -101,110 +309,351 @@ func (p *AwsProvisioner) Provision(ctx context.Context, id string, args provisio
 		}
 		return stdout, err
 	})
+	metrics.ObservePhase("aws", "init_script", phaseStart)
 	if err != nil {
 		removeHandler()
 		return provision.ProvisionResult{}, err
 	}
 
 	return provision.ProvisionResult{
-		ServerIP:        net.ParseIP(stackOutput["ServerIp"]),
+		ServerIP:        serverIp,
 		ServerWgIp:      args.ServerWgIp,
 		ServerPublicKey: string(outputParams.ServerWgPublicKey),
+		InterfaceName:   outputParams.InterfaceName,
+		InstanceType:    args.InstanceType,
+		VolumeMountPath: outputParams.VolumeMountPath,
+		ServerConfig:    outputParams.ServerConfig,
 	}, nil
 }
 
-func (p *AwsProvisioner) DeProvision(ctx context.Context, id string, args provision.DeProvisionArguments) error {
+func (p *AwsProvisioner) DeProvision(ctx context.Context, id string, args provision.DeProvisionArguments) (err error) {
+	defer func() {
+		metrics.ObserveOperation("aws", "deprovision", err)
+	}()
+
 	log.Info("Initialize SDK clients", "region", args.Region)
-	err := p.initSdkClients(ctx, args.Region)
+	err = p.initSdkClients(ctx, args.Region)
+	if err != nil {
+		return err
+	}
+
+	deleteStackTask := func(stackName string) func() error {
+		return func() error {
+			attempt := 0
+			return retry(ctx, stackDeleteAttempts, stackDeleteRetryDelay, func() error {
+				attempt++
+				log.Info("Deleting stack", "stackName", stackName, "attempt", attempt)
+				return p.deleteStack(ctx, stackName)
+			})
+		}
+	}
+
+	tasks := []func() error{
+		deleteStackTask(id),
+	}
+	if args.RemoveBootstrap {
+		tasks = append(tasks, func() error {
+			identity, err := p.stsClient.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+			if err != nil {
+				return err
+			}
+
+			bucketName := fmt.Sprintf("cdk-%s-assets-%s-%s", buildArgCustomQualifier, *identity.Account, args.Region)
+			attempt := 0
+			log.Info("Emptying bucket", "bucketName", bucketName)
+			return retry(ctx, bucketDeleteAttempts, bucketDeleteRetryDelay, func() error {
+				attempt++
+				log.Info("Deleting bucket", "bucketName", bucketName, "attempt", attempt)
+				return p.deleteBucket(ctx, bucketName)
+			})
+		}, deleteStackTask(bootstrapStackName))
+	}
+
+	err = provision.RunTasks(p.DeProvisionConcurrency, tasks)
 	if err != nil {
 		return err
 	}
 
-	wg := sync.WaitGroup{}
-	errorsChannel := make(chan error, 16)
+	log.Info("Done", "id", id)
+	return nil
+}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		identity, err := p.stsClient.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
-		if err != nil {
-			errorsChannel <- err
-			return
+// the bucket usually succeeds once concurrent uploads have settled, while a stack
+// deletion mostly fails on resources that take a while to release, e.g. the bucket
+const (
+	bucketDeleteAttempts   = 20
+	bucketDeleteRetryDelay = 1 * time.Second
+	stackDeleteAttempts    = 5
+	stackDeleteRetryDelay  = 15 * time.Second
+)
+
+// retry calls f up to attempts times, waiting delay between the attempts, until it succeeds.
+// The error of the last attempt is returned wrapped.
+func retry(ctx context.Context, attempts int, delay time.Duration, f func() error) error {
+	var lastError error
+	for retries := attempts; retries > 0; retries-- {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 
-		bucketName := fmt.Sprintf("cdk-%s-assets-%s-%s", buildArgCustomQualifier, *identity.Account, args.Region)
-		attempt := 0
-		errorsChannel <- retry(func() error {
-			attempt++
-			log.Info("Deleting bucket", "bucketName", bucketName, "attempt", attempt)
-			return p.deleteBucket(ctx, bucketName)
-		})
+		err := f()
+		if err == nil {
+			return nil
+		}
+
+		// f may wrap the cancellation or fail for an unrelated reason at the same time,
+		// either way there is no point in another attempt
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if errors.Is(err, context.Canceled) {
+			return err
+		}
+		lastError = err
+
+		if retries == 1 {
+			break
+		}
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("failed after %d attempts: %w", attempts, lastError)
+}
+
+// sleepContext waits for the given duration or until the context is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Bootstrap provisions the bootstrap stack of the account and region, which deploy
+// otherwise creates on the fly. It may need more permissions than deploy.
+func (p *AwsProvisioner) Bootstrap(ctx context.Context, args provision.InstanceArguments) (err error) {
+	defer func() {
+		metrics.ObserveOperation("aws", "bootstrap", err)
 	}()
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+	err = p.initSdkClients(ctx, args.Region)
+	if err != nil {
+		return err
+	}
+
+	// bootstrapping explicitly is the place to bring an old bootstrap up to date
+	return p.bootstrap(ctx, stackOptions{
+		Tags: map[string]string{provision.ManagedByTag: provision.ManagedByValue},
+	}, true)
+}
+
+// bootstrap creates the bootstrap stack if it is missing. An outdated one is updated
+// if updateStale is set and an error otherwise.
+func (p *AwsProvisioner) bootstrap(ctx context.Context, opts stackOptions, updateStale bool) error {
+	if err := p.requireBootstrap(ctx); err != nil {
+		log.Debug("Bootstrap stack not ready", "err", err)
+		log.Info("Provisioning bootstrap stack", "stackName", bootstrapStackName)
+		_, _, err = p.provisionStack(ctx, bootstrapStackName, bootstrapTemplate, map[string]string{}, opts)
+		return err
+	}
+
+	err := p.checkBootstrapVersion(ctx)
+	if errors.Is(err, errBootstrapTooOld) && updateStale {
+		log.Warn("Updating bootstrap stack", "stackName", bootstrapStackName, "reason", err)
+		err = p.updateBootstrapStack(ctx, opts)
+		if err != nil {
+			return err
+		}
+		err = p.checkBootstrapVersion(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Info("Bootstrap stack is up to date", "stackName", bootstrapStackName)
+	return nil
+}
 
-		attempt := 0
-		errorsChannel <- retry(func() error {
-			attempt++
-			log.Info("Deleting stack", "stackName", id, "attempt", attempt)
-			return p.deleteStack(ctx, bootstrapStackName)
+// updateBootstrapStack updates the bootstrap stack in place with the embedded template.
+// It is not deleted and recreated, the bucket and roles keep their names, so other
+// deployments sharing the bootstrap keep working. Cloudformation rejects the update
+// while another one is in progress.
+func (p *AwsProvisioner) updateBootstrapStack(ctx context.Context, opts stackOptions) error {
+	input := &cloudformation.UpdateStackInput{
+		StackName:    pstr(bootstrapStackName),
+		TemplateBody: pstr(bootstrapTemplate),
+		Capabilities: []cfTypes.Capability{
+			cfTypes.CapabilityCapabilityNamedIam,
+		},
+	}
+	for k, v := range opts.Tags {
+		input.Tags = append(input.Tags, cfTypes.Tag{
+			Key:   pstr(k),
+			Value: pstr(v),
 		})
-	}()
+	}
+	if p.CfnRoleArn != "" {
+		input.RoleARN = pstr(p.CfnRoleArn)
+	}
+
+	_, err := p.cfClient.UpdateStack(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to update bootstrap stack: %w", err)
+	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+	for {
+		if err := sleepContext(ctx, 10*time.Second); err != nil {
+			return err
+		}
 
-		attempt := 0
-		errorsChannel <- retry(func() error {
-			attempt++
-			log.Info("Deleting stack", "stackName", id, "attempt", attempt)
-			return p.deleteStack(ctx, id)
+		resp, err := p.cfClient.DescribeStacks(ctx, &cloudformation.DescribeStacksInput{
+			StackName: pstr(bootstrapStackName),
 		})
-	}()
+		if err != nil {
+			return err
+		}
+		if len(resp.Stacks) == 0 {
+			return fmt.Errorf("bootstrap stack %s disappeared during the update", bootstrapStackName)
+		}
 
-	errs := make([]error, 0)
-	errsCollectDone := make(chan struct{})
-	go func() {
-		for err := range errorsChannel {
-			if err != nil {
-				errs = append(errs, err)
-			}
+		switch status := resp.Stacks[0].StackStatus; status {
+		case cfTypes.StackStatusUpdateComplete:
+			return nil
+		case cfTypes.StackStatusUpdateRollbackComplete, cfTypes.StackStatusUpdateRollbackFailed, cfTypes.StackStatusUpdateFailed:
+			reasons, _ := p.getFailureReasons(ctx, bootstrapStackName)
+			return fmt.Errorf("bootstrap stack update failed with %s: %s", status, strings.Join(reasons, "; "))
+		default:
+			log.Debug("Updating...", "stackName", bootstrapStackName, "status", status)
 		}
+	}
+}
 
-		close(errsCollectDone)
-	}()
+var errBootstrapTooOld = errors.New("bootstrap stack is too old")
+
+// checkBootstrapVersion fails with errBootstrapTooOld if the existing bootstrap stack
+// publishes an older version than the embedded cdk.out requires. The asset upload and
+// the stack would fail with less helpful errors otherwise.
+func (p *AwsProvisioner) checkBootstrapVersion(ctx context.Context) error {
+	requirement, err := requiredBootstrapVersion(p.stsClient)
+	if err != nil {
+		return err
+	}
+	if requirement.SsmParameter == "" {
+		return nil
+	}
+
+	version, err := p.bootstrapVersion(ctx, requirement.SsmParameter)
+	if err != nil {
+		return err
+	}
 
-	wg.Wait()
-	close(errorsChannel)
-	<-errsCollectDone
+	if version < requirement.Version {
+		return fmt.Errorf("%w: %s is version %d, the embedded cdk assets require %d, update it with bootstrap or deploy --force-bootstrap", errBootstrapTooOld, requirement.SsmParameter, version, requirement.Version)
+	}
 
-	return errors.Join(errs...)
+	return nil
 }
 
-func retry(f func() error) error {
-	var lastError error
-	for retries := 20; retries > 0; retries-- {
-		err := f()
-		if err == nil {
-			return nil
+// bootstrapVersion reads the version the bootstrap stack published in parameter, 0 if it is missing.
+func (p *AwsProvisioner) bootstrapVersion(ctx context.Context, parameter string) (int, error) {
+	resp, err := p.ssmClient.GetParameter(ctx, &ssm.GetParameterInput{
+		Name: pstr(parameter),
+	})
+	if err != nil {
+		var notFound *ssmTypes.ParameterNotFound
+		if errors.As(err, &notFound) {
+			return 0, nil
 		}
+		return 0, err
+	}
 
-		if errors.Is(err, context.Canceled) {
+	version, err := strconv.Atoi(aws.ToString(resp.Parameter.Value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid bootstrap version in %s: %w", parameter, err)
+	}
+
+	return version, nil
+}
+
+// requireBootstrap fails if the bootstrap stack has not been created successfully.
+func (p *AwsProvisioner) requireBootstrap(ctx context.Context) error {
+	resp, err := p.cfClient.DescribeStacks(ctx, &cloudformation.DescribeStacksInput{
+		StackName: pstr(bootstrapStackName),
+	})
+	if err != nil && !strings.Contains(err.Error(), "does not exist") {
+		return err
+	}
+
+	if err != nil || len(resp.Stacks) == 0 {
+		return fmt.Errorf("bootstrap stack %s does not exist in region %s, run bootstrap first", bootstrapStackName, p.cfClient.Options().Region)
+	}
+
+	switch status := resp.Stacks[0].StackStatus; status {
+	case cfTypes.StackStatusCreateComplete, cfTypes.StackStatusUpdateComplete:
+		return nil
+	default:
+		return fmt.Errorf("bootstrap stack %s is %s, run bootstrap first", bootstrapStackName, status)
+	}
+}
+
+// resumeExistingStack handles a stack that already exists when it should be created,
+// e.g. because an earlier run was killed. Running creates and updates are waited for
+// by the caller like a fresh create, a running deletion is awaited here and the stack
+// created again. A stack whose create failed cannot be updated, it is replaced the same way.
+func (p *AwsProvisioner) resumeExistingStack(ctx context.Context, input *cloudformation.CreateStackInput) error {
+	stackName := aws.ToString(input.StackName)
+	resp, err := p.cfClient.DescribeStacks(ctx, &cloudformation.DescribeStacksInput{
+		StackName: input.StackName,
+	})
+	if err != nil {
+		return err
+	}
+	if len(resp.Stacks) == 0 {
+		return nil
+	}
+
+	switch status := resp.Stacks[0].StackStatus; status {
+	case cfTypes.StackStatusCreateFailed, cfTypes.StackStatusRollbackComplete:
+		log.Info("Replacing the failed existing stack", "stackName", stackName, "status", status)
+		fallthrough
+	case cfTypes.StackStatusDeleteInProgress:
+		log.Info("Waiting for the deletion of the existing stack", "stackName", stackName)
+		err = p.deleteStack(ctx, stackName)
+		if err != nil {
 			return err
-		} else {
-			lastError = err
 		}
 
-		time.Sleep(1 * time.Second)
+		_, err = p.cfClient.CreateStack(ctx, input)
+		return err
+	case cfTypes.StackStatusCreateInProgress, cfTypes.StackStatusUpdateInProgress, cfTypes.StackStatusUpdateCompleteCleanupInProgress:
+		log.Info("Stack operation already in progress, waiting for it", "stackName", stackName, "status", status)
+		return nil
+	default:
+		log.Debug("Stack already exists", "stackName", stackName, "status", status)
+		return nil
 	}
+}
 
-	return lastError
+// stackOptions are the settings shared by all stacks of a deployment.
+type stackOptions struct {
+	OnFailure     cfTypes.OnFailure
+	KeepOnFailure bool
+	// Tags are propagated by cloudformation to all resources of the stack.
+	Tags map[string]string
+	// NoIam creates the stack without CAPABILITY_NAMED_IAM, for templates that
+	// create no iam resources.
+	NoIam bool
 }
 
-func (p *AwsProvisioner) provisionStack(ctx context.Context, stackName, templateBody string, params map[string]string) (map[string]string, func(), error) {
+// provisionStack creates the stack and waits for it. A failed stack is deleted
+// unless KeepOnFailure is set or OnFailure tells cloudformation to retain it.
+func (p *AwsProvisioner) provisionStack(ctx context.Context, stackName, templateBody string, params map[string]string, opts stackOptions) (map[string]string, func(), error) {
 	removeHandler := func() {
 	}
 
@@ -216,38 +665,80 @@ func (p *AwsProvisioner) provisionStack(ctx context.Context, stackName, template
 		})
 	}
 
-	_, err := p.cfClient.CreateStack(ctx, &cloudformation.CreateStackInput{
+	createStackInput := &cloudformation.CreateStackInput{
 		StackName:    pstr(stackName),
 		TemplateBody: pstr(templateBody),
-		Capabilities: []cfTypes.Capability{
+		Parameters:   cdkParameterList,
+	}
+	if !opts.NoIam {
+		createStackInput.Capabilities = []cfTypes.Capability{
 			cfTypes.CapabilityCapabilityNamedIam,
-		},
-		Parameters: cdkParameterList,
-	})
+		}
+	}
+	for k, v := range opts.Tags {
+		createStackInput.Tags = append(createStackInput.Tags, cfTypes.Tag{
+			Key:   pstr(k),
+			Value: pstr(v),
+		})
+	}
+	if p.CfnRoleArn != "" {
+		createStackInput.RoleARN = pstr(p.CfnRoleArn)
+	}
+	if opts.OnFailure != "" {
+		createStackInput.OnFailure = opts.OnFailure
+	}
+	keepOnFailure := opts.KeepOnFailure
+	if opts.OnFailure == cfTypes.OnFailureDoNothing || opts.OnFailure == cfTypes.OnFailureRollback {
+		keepOnFailure = true
+	}
+
+	_, err := p.cfClient.CreateStack(ctx, createStackInput)
 	if err != nil {
 		if !strings.Contains(err.Error(), "AlreadyExistsException") {
 			return nil, removeHandler, err
 		}
+
+		err = p.resumeExistingStack(ctx, createStackInput)
+		if err != nil {
+			return nil, removeHandler, err
+		}
 	}
 
 	removeHandler = func() {
-		_, err := p.cfClient.DeleteStack(ctx, &cloudformation.DeleteStackInput{
+		// cleanup has to run even if ctx was cancelled or its deadline exceeded
+		_, err := p.cfClient.DeleteStack(context.WithoutCancel(ctx), &cloudformation.DeleteStackInput{
 			StackName: pstr(stackName),
 		})
 		if err != nil {
 			log.Error("Failed to delete stack", "err", err)
 		}
 	}
+	cleanup := func() {
+		if keepOnFailure {
+			log.Warn("Keeping failed stack, remove it with delete", "stackName", stackName)
+			return
+		}
+		removeHandler()
+	}
 
 	// wait for stack to be created
 	log.Debug("Waiting for stack to be created", "stackName", stackName)
+	seenEvents := map[string]bool{}
 	for {
-		time.Sleep(10 * time.Second)
+		if err := sleepContext(ctx, 10*time.Second); err != nil {
+			cleanup()
+			return nil, removeHandler, err
+		}
+
+		if log.GetLevel() <= log.DebugLevel {
+			p.logNewStackEvents(ctx, stackName, seenEvents)
+		}
+
 		resp, err := p.cfClient.DescribeStacks(ctx, &cloudformation.DescribeStacksInput{
 			StackName: pstr(stackName),
 		})
 		if err != nil {
-			removeHandler()
+			cleanup()
 			return nil, removeHandler, err
 		}
 
@@ -255,7 +746,13 @@ func (p *AwsProvisioner) provisionStack(ctx context.Context, stackName, template
 			continue
 		}
 
-		if resp.Stacks[0].StackStatus == cfTypes.StackStatusCreateComplete {
+		if resp.Stacks[0].StackStatus == cfTypes.StackStatusUpdateRollbackComplete {
+			log.Warn("The last update of the existing stack was rolled back, using it anyway", "stackName", stackName)
+		}
+
+		if resp.Stacks[0].StackStatus == cfTypes.StackStatusCreateComplete ||
+			resp.Stacks[0].StackStatus == cfTypes.StackStatusUpdateComplete ||
+			resp.Stacks[0].StackStatus == cfTypes.StackStatusUpdateRollbackComplete {
 			outputParams := map[string]string{}
 			for _, output := range resp.Stacks[0].Outputs {
 				outputParams[*output.OutputKey] = *output.OutputValue
@@ -280,12 +777,14 @@ func (p *AwsProvisioner) provisionStack(ctx context.Context, stackName, template
 			}
 
 			log.Error("Stack creation failed", "reason", reason)
-			removeHandler()
+			cleanup()
 			return nil, removeHandler, errors.New("stack creation failed")
 		}
 	}
 }
 
+// deleteStack deletes the stack and waits until it is gone. Deleting a stack that does not
+// exist succeeds, as does a stack in DELETE_FAILED once the deletion is retried.
 func (p *AwsProvisioner) deleteStack(ctx context.Context, stackName string) error {
 	_, err := p.cfClient.DeleteStack(ctx, &cloudformation.DeleteStackInput{
 		StackName: pstr(stackName),
@@ -320,7 +819,9 @@ func (p *AwsProvisioner) deleteStack(ctx context.Context, stackName string) erro
 
 		log.Debug("Deleting...", "stackName", stackName)
 
-		time.Sleep(10 * time.Second)
+		if err := sleepContext(ctx, 10*time.Second); err != nil {
+			return err
+		}
 	}
 }
 
@@ -330,7 +831,7 @@ func (p *AwsProvisioner) deleteBucket(ctx context.Context, bucketName string) er
 		Bucket: pstr(bucketName),
 	})
 	if err != nil {
-		if strings.Contains(err.Error(), "NoSuchBucket") {
+		if isNoSuchBucket(err) {
 			return nil
 		}
 
@@ -354,6 +855,10 @@ func (p *AwsProvisioner) deleteBucket(ctx context.Context, bucketName string) er
 		Bucket: pstr(bucketName),
 	})
 	if err != nil {
+		if isNoSuchBucket(err) {
+			return nil
+		}
+
 		return err
 	}
 	var deleteObjects []s3.DeleteObjectInput
@@ -388,13 +893,46 @@ func (p *AwsProvisioner) deleteBucket(ctx context.Context, bucketName string) er
 	_, err = p.s3Client.DeleteBucket(ctx, &s3.DeleteBucketInput{
 		Bucket: pstr(bucketName),
 	})
-	if err != nil {
+	if err != nil && !isNoSuchBucket(err) {
 		return err
 	}
 
 	return nil
 }
 
+// isNoSuchBucket reports whether err says the bucket is already gone, e.g. removed by
+// an earlier, partially failed delete, which counts as deleted.
+func isNoSuchBucket(err error) bool {
+	return strings.Contains(err.Error(), "NoSuchBucket")
+}
+
+// logNewStackEvents logs the stack events not in seen yet, oldest first, and adds them to seen.
+func (p *AwsProvisioner) logNewStackEvents(ctx context.Context, stackName string, seen map[string]bool) {
+	events, err := p.cfClient.DescribeStackEvents(ctx, &cloudformation.DescribeStackEventsInput{
+		StackName: pstr(stackName),
+	})
+	if err != nil {
+		log.Debug("Failed to get stack events", "err", err)
+		return
+	}
+
+	// events are returned newest first
+	for i := len(events.StackEvents) - 1; i >= 0; i-- {
+		event := events.StackEvents[i]
+		eventId := aws.ToString(event.EventId)
+		if seen[eventId] {
+			continue
+		}
+		seen[eventId] = true
+
+		log.Debug("Stack event",
+			"resource", aws.ToString(event.LogicalResourceId),
+			"type", aws.ToString(event.ResourceType),
+			"status", event.ResourceStatus,
+			"reason", aws.ToString(event.ResourceStatusReason))
+	}
+}
+
 func (p *AwsProvisioner) getFailureReasons(ctx context.Context, stackName string) ([]string, error) {
 	events, err := p.cfClient.DescribeStackEvents(ctx, &cloudformation.DescribeStackEventsInput{
 		StackName: pstr(stackName),
@@ -434,11 +972,34 @@ func (p *AwsProvisioner) waitUntilUp(ctx context.Context, instanceId string) err
 			lastError = err
 		}
 
-		time.Sleep(10 * time.Second)
+		if err := sleepContext(ctx, 10*time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+// checkInstanceInRegion fails if instanceId does not exist in the region of the clients.
+// ssm commands for an instance of another region would only fail by timing out.
+func (p *AwsProvisioner) checkInstanceInRegion(ctx context.Context, instanceId string) error {
+	resp, err := p.ec2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{instanceId},
+	})
+	if err != nil && !strings.Contains(err.Error(), "InvalidInstanceID") {
+		return err
+	}
+	if err != nil || len(resp.Reservations) == 0 || len(resp.Reservations[0].Instances) == 0 {
+		return fmt.Errorf("instance %s not found in region %s", instanceId, p.ec2Client.Options().Region)
 	}
+
+	return nil
 }
 
 func (p *AwsProvisioner) runShell(ctx context.Context, instanceId string, script string) (stdout, stderr string, err error) {
+	err = p.checkInstanceInRegion(ctx, instanceId)
+	if err != nil {
+		return "", "", err
+	}
+
 	log.Debug("Running shell script", "instanceId", instanceId)
 	res, err := p.ssmClient.SendCommand(ctx, &ssm.SendCommandInput{
 		DocumentName: pstr("AWS-RunShellScript"),
@@ -455,7 +1016,10 @@ func (p *AwsProvisioner) runShell(ctx context.Context, instanceId string, script
 
 	// wait for command to finish
 	for {
-		time.Sleep(10 * time.Second)
+		if err := sleepContext(ctx, 10*time.Second); err != nil {
+			return "", "", err
+		}
+
 		resp, err := p.ssmClient.GetCommandInvocation(ctx, &ssm.GetCommandInvocationInput{
 			CommandId:  res.Command.CommandId,
 			InstanceId: pstr(instanceId),
@@ -466,40 +1030,634 @@ func (p *AwsProvisioner) runShell(ctx context.Context, instanceId string, script
 
 		log.Debug("Command status", "status", resp.Status)
 
+		stdout, stderr := *resp.StandardOutputContent, *resp.StandardErrorContent
 		if resp.Status == ssmTypes.CommandInvocationStatusSuccess {
 			if resp.ResponseCode != 0 {
-				return *resp.StandardOutputContent, *resp.StandardErrorContent, errors.New("command failed")
+				return stdout, stderr, provision.WithOutput(errors.New("command failed"), stderr)
 			}
 
-			return *resp.StandardOutputContent, *resp.StandardErrorContent, nil
+			return stdout, stderr, nil
 		} else if resp.Status == ssmTypes.CommandInvocationStatusFailed {
-			return *resp.StandardOutputContent, *resp.StandardErrorContent, errors.New("command failed")
+			return stdout, stderr, provision.WithOutput(errors.New("command failed"), stderr)
 		} else if resp.Status == ssmTypes.CommandInvocationStatusTimedOut {
-			return *resp.StandardOutputContent, *resp.StandardErrorContent, errors.New("command timed out")
+			return stdout, stderr, provision.WithOutput(errors.New("command timed out"), stderr)
 		} else if resp.Status == ssmTypes.CommandInvocationStatusCancelling {
-			return *resp.StandardOutputContent, *resp.StandardErrorContent, errors.New("command was cancelled")
+			return stdout, stderr, errors.New("command was cancelled")
 		} else if resp.Status == ssmTypes.CommandInvocationStatusCancelled {
-			return *resp.StandardOutputContent, *resp.StandardErrorContent, errors.New("command was cancelled")
+			return stdout, stderr, errors.New("command was cancelled")
 		}
 	}
 }
 
+func (p *AwsProvisioner) Stop(ctx context.Context, id string, args provision.InstanceArguments) error {
+	err := p.initSdkClients(ctx, args.Region)
+	if err != nil {
+		return err
+	}
+
+	instanceId, err := p.instanceId(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Stopping instance", "instanceId", instanceId)
+	_, err = p.ec2Client.StopInstances(ctx, &ec2.StopInstancesInput{
+		InstanceIds: []string{instanceId},
+	})
+	if err != nil {
+		return err
+	}
+
+	return ec2.NewInstanceStoppedWaiter(p.ec2Client).Wait(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{instanceId},
+	}, 10*time.Minute)
+}
+
+func (p *AwsProvisioner) Start(ctx context.Context, id string, args provision.InstanceArguments) error {
+	err := p.initSdkClients(ctx, args.Region)
+	if err != nil {
+		return err
+	}
+
+	instanceId, err := p.instanceId(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Starting instance", "instanceId", instanceId)
+	_, err = p.ec2Client.StartInstances(ctx, &ec2.StartInstancesInput{
+		InstanceIds: []string{instanceId},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = ec2.NewInstanceRunningWaiter(p.ec2Client).Wait(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{instanceId},
+	}, 10*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	log.Warn("The public IP may have changed unless the instance has a static IP, update the client endpoint if needed")
+	return nil
+}
+
+func (p *AwsProvisioner) Usage(ctx context.Context, id string, args provision.InstanceArguments) (provision.UsageReport, error) {
+	err := p.initSdkClients(ctx, args.Region)
+	if err != nil {
+		return provision.UsageReport{}, err
+	}
+
+	instanceId, err := p.instanceId(ctx, id)
+	if err != nil {
+		return provision.UsageReport{}, err
+	}
+
+	command, err := provision.WgTransferCommand(args.InterfaceName)
+	if err != nil {
+		return provision.UsageReport{}, err
+	}
+
+	stdout, stderr, err := p.runShell(ctx, instanceId, command)
+	if err != nil {
+		log.Error("Failed to read wireguard transfer", "err", err, "stderr", stderr)
+		return provision.UsageReport{}, err
+	}
+
+	peers, err := provision.ParseWgTransfer(stdout)
+	if err != nil {
+		return provision.UsageReport{}, err
+	}
+
+	return provision.UsageReport{
+		Peers: peers,
+	}, nil
+}
+
+func (p *AwsProvisioner) AddPeer(ctx context.Context, id string, peer provision.Peer, args provision.InstanceArguments) error {
+	command, err := provision.AddPeerCommand(args.InterfaceName, peer)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Adding peer", "publicKey", peer.PublicKey, "ip", peer.WgIp)
+	return p.runPeerCommand(ctx, id, args, command)
+}
+
+func (p *AwsProvisioner) RemovePeer(ctx context.Context, id string, publicKey string, args provision.InstanceArguments) error {
+	command, err := provision.RemovePeerCommand(args.InterfaceName, publicKey)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Removing peer", "publicKey", publicKey)
+	return p.runPeerCommand(ctx, id, args, command)
+}
+
+func (p *AwsProvisioner) runPeerCommand(ctx context.Context, id string, args provision.InstanceArguments, command string) error {
+	err := p.initSdkClients(ctx, args.Region)
+	if err != nil {
+		return err
+	}
+
+	instanceId, err := p.instanceId(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	_, stderr, err := p.runShell(ctx, instanceId, command)
+	if err != nil {
+		log.Error("Failed to update peers", "err", err, "stderr", stderr)
+		return err
+	}
+
+	return nil
+}
+
+func (p *AwsProvisioner) Diagnose(ctx context.Context, args provision.InstanceArguments) []provision.CheckResult {
+	// every aws call needs a region, including the credentials probe
+	if args.Region == "" {
+		return []provision.CheckResult{{Name: "region", Skipped: "not set, pass --region to run the other checks"}}
+	}
+
+	err := fmt.Errorf("unknown region %q", args.Region)
+	for _, loc := range locations {
+		if loc.Key == args.Region {
+			err = nil
+			break
+		}
+	}
+	results := []provision.CheckResult{{Name: "region", Err: err}}
+
+	// loading the config probes the credentials
+	err = p.initSdkClients(ctx, args.Region)
+	if err != nil {
+		return append(results, provision.CheckResult{Name: "credentials", Err: err})
+	}
+	results = append(results, provision.CheckResult{Name: "credentials"})
+
+	// any stack, diagnose does not know the id
+	results = append(results, p.permissionChecks(ctx, "*")...)
+
+	_, err = p.cfClient.ValidateTemplate(ctx, &cloudformation.ValidateTemplateInput{
+		TemplateBody: pstr(cdkTemplate),
+	})
+	results = append(results, provision.CheckResult{Name: "cloudformation template", Err: err})
+
+	_, err = p.ssmClient.DescribeInstanceInformation(ctx, &ssm.DescribeInstanceInformationInput{})
+	results = append(results, provision.CheckResult{Name: "ssm access", Err: err})
+
+	_, err = p.ec2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{})
+	results = append(results, provision.CheckResult{Name: "ec2 access", Err: err})
+
+	return results
+}
+
+// preflight checks the permissions provisioning the stack id needs and returns an error
+// listing everything that is missing. Permissions that can not be checked only warn.
+func (p *AwsProvisioner) preflight(ctx context.Context, id string) error {
+	var missing []string
+	if _, err := p.ssmClient.DescribeInstanceInformation(ctx, &ssm.DescribeInstanceInformationInput{}); err != nil {
+		missing = append(missing, "ssm:DescribeInstanceInformation ("+err.Error()+")")
+	}
+
+	for _, result := range p.permissionChecks(ctx, id) {
+		if result.Err != nil {
+			missing = append(missing, result.Name+" ("+result.Err.Error()+")")
+		} else if result.Skipped != "" {
+			log.Warn("Could not check permission", "permission", result.Name, "reason", result.Skipped)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing permissions:\n  %s", strings.Join(missing, "\n  "))
+	}
+
+	return nil
+}
+
+// permissionChecks checks the permissions provisioning the stack stackName needs, "*" for
+// any stack. cloudformation:CreateStack, iam:PassRole of CfnRoleArn and s3:PutObject into
+// the cdk asset buckets are simulated for the caller with iam:SimulatePrincipalPolicy,
+// read-only calls would pass for principals that can not create anything. The cdk
+// roles are assumed.
+func (p *AwsProvisioner) permissionChecks(ctx context.Context, stackName string) []provision.CheckResult {
+	identity, err := p.stsClient.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return []provision.CheckResult{{Name: "sts:GetCallerIdentity", Err: err}}
+	}
+	callerArn := aws.ToString(identity.Arn)
+	partition := "aws"
+	if parts := strings.Split(callerArn, ":"); len(parts) > 1 {
+		partition = parts[1]
+	}
+
+	type permission struct {
+		action   string
+		resource string
+	}
+	permissions := []permission{{
+		action:   "cloudformation:CreateStack",
+		resource: fmt.Sprintf("arn:%s:cloudformation:%s:%s:stack/%s/*", partition, p.cfClient.Options().Region, aws.ToString(identity.Account), stackName),
+	}}
+	if p.CfnRoleArn != "" {
+		permissions = append(permissions, permission{action: "iam:PassRole", resource: p.CfnRoleArn})
+	}
+
+	var results []provision.CheckResult
+	var roleArns []string
+	// the cdk roles and the asset buckets only exist once the bootstrap stack is deployed
+	if _, err := p.stackOutputs(ctx, bootstrapStackName); err == nil {
+		buckets, err := cdkAssetBuckets(ctx, p.stsClient)
+		if err != nil {
+			return append(results, provision.CheckResult{Name: "cdk asset buckets", Err: err})
+		}
+		for _, bucket := range buckets {
+			permissions = append(permissions, permission{action: "s3:PutObject", resource: fmt.Sprintf("arn:%s:s3:::%s/*", partition, bucket)})
+		}
+
+		roleArns, err = cdkRoleArns(ctx, p.stsClient)
+		if err != nil {
+			return append(results, provision.CheckResult{Name: "cdk roles", Err: err})
+		}
+	} else {
+		results = append(results, provision.CheckResult{
+			Name:    "s3:PutObject and sts:AssumeRole of the cdk bootstrap",
+			Skipped: "the bootstrap stack does not exist yet",
+		})
+	}
+
+	policySourceArn, sourceErr := p.policySourceArn(ctx, callerArn)
+	for _, permission := range permissions {
+		name := permission.action + " on " + permission.resource
+		if sourceErr != nil {
+			results = append(results, provision.CheckResult{Name: name, Skipped: sourceErr.Error()})
+			continue
+		}
+
+		resp, err := p.iamClient.SimulatePrincipalPolicy(ctx, &iam.SimulatePrincipalPolicyInput{
+			PolicySourceArn: pstr(policySourceArn),
+			ActionNames:     []string{permission.action},
+			ResourceArns:    []string{permission.resource},
+		})
+		if err != nil {
+			results = append(results, provision.CheckResult{Name: name, Skipped: "iam:SimulatePrincipalPolicy failed: " + err.Error()})
+			continue
+		}
+
+		var denied error
+		for _, result := range resp.EvaluationResults {
+			if result.EvalDecision != iamTypes.PolicyEvaluationDecisionTypeAllowed {
+				denied = fmt.Errorf("%s for %s", result.EvalDecision, policySourceArn)
+			}
+		}
+		results = append(results, provision.CheckResult{Name: name, Err: denied})
+	}
+
+	for _, roleArn := range roleArns {
+		_, err := p.stsClient.AssumeRole(ctx, &sts.AssumeRoleInput{
+			RoleArn:         pstr(roleArn),
+			RoleSessionName: pstr("wg-ondemand-preflight"),
+		})
+		results = append(results, provision.CheckResult{Name: "sts:AssumeRole on " + roleArn, Err: err})
+	}
+
+	return results
+}
+
+// policySourceArn returns the iam user or role whose policies apply to callerArn. An
+// assumed role session is resolved to its role, which needs iam:GetRole because the
+// session arn lacks the path of the role.
+func (p *AwsProvisioner) policySourceArn(ctx context.Context, callerArn string) (string, error) {
+	parts := strings.SplitN(callerArn, ":", 6)
+	if len(parts) != 6 {
+		return "", fmt.Errorf("invalid caller arn %q", callerArn)
+	}
+
+	service, resource := parts[2], parts[5]
+	switch {
+	case service == "iam" && (strings.HasPrefix(resource, "user/") || strings.HasPrefix(resource, "role/")):
+		return callerArn, nil
+	case service == "sts" && strings.HasPrefix(resource, "assumed-role/"):
+		roleName, _, _ := strings.Cut(strings.TrimPrefix(resource, "assumed-role/"), "/")
+		resp, err := p.iamClient.GetRole(ctx, &iam.GetRoleInput{RoleName: pstr(roleName)})
+		if err != nil {
+			return "", fmt.Errorf("can not resolve the role of %s: %w", callerArn, err)
+		}
+		return aws.ToString(resp.Role.Arn), nil
+	default:
+		return "", fmt.Errorf("the policies of %s can not be simulated", callerArn)
+	}
+}
+
+func (p *AwsProvisioner) Status(ctx context.Context, id string, args provision.InstanceArguments) (provision.StatusReport, error) {
+	err := p.initSdkClients(ctx, args.Region)
+	if err != nil {
+		return provision.StatusReport{}, err
+	}
+
+	outputs, err := p.stackOutputs(ctx, id)
+	if err != nil {
+		if strings.Contains(err.Error(), "does not exist") {
+			return provision.StatusReport{}, nil
+		}
+		return provision.StatusReport{}, err
+	}
+
+	report := provision.StatusReport{
+		Exists:   true,
+		ServerIP: net.ParseIP(outputs["ServerIp"]),
+	}
+
+	instanceId := outputs["InstanceId"]
+	if instanceId == "" {
+		return report, nil
+	}
+
+	instances, err := p.ec2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{instanceId},
+	})
+	if err != nil {
+		return report, err
+	}
+
+	for _, reservation := range instances.Reservations {
+		for _, instance := range reservation.Instances {
+			if instance.State != nil && instance.State.Name == ec2Types.InstanceStateNameRunning {
+				report.Running = true
+			}
+		}
+	}
+
+	if !report.Running {
+		return report, nil
+	}
+
+	output, err := provision.ReadInitScriptOutput(func(script string) (string, error) {
+		stdout, _, err := p.runShell(ctx, instanceId, script)
+		return stdout, err
+	})
+	if err != nil {
+		return report, err
+	}
+
+	if output != nil {
+		report.Ready = true
+		report.ServerPublicKey = output.ServerWgPublicKey
+	}
+
+	return report, nil
+}
+
+// Logs returns the failure reasons of the stack and the output of the ssm commands
+// run on the instance. Both are best effort, the stack may already be deleted.
+func (p *AwsProvisioner) Logs(ctx context.Context, id string, args provision.InstanceArguments) ([]provision.LogSection, error) {
+	err := p.initSdkClients(ctx, args.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	var sections []provision.LogSection
+
+	reasons, err := p.getFailureReasons(ctx, id)
+	if err != nil {
+		log.Warn("Failed to get stack events", "err", err)
+	} else {
+		sections = append(sections, provision.LogSection{
+			Title:   "stack failures",
+			Content: strings.Join(reasons, "\n"),
+		})
+	}
+
+	instanceId, err := p.instanceId(ctx, id)
+	if err != nil {
+		log.Warn("Failed to get instance id, skipping ssm command output", "err", err)
+		return sections, nil
+	}
+
+	invocations, err := p.ssmClient.ListCommandInvocations(ctx, &ssm.ListCommandInvocationsInput{
+		InstanceId: pstr(instanceId),
+		Details:    true,
+	})
+	if err != nil {
+		return sections, err
+	}
+
+	for _, invocation := range invocations.CommandInvocations {
+		title := fmt.Sprintf("ssm command %s (%s)", aws.ToString(invocation.CommandId), invocation.Status)
+		if invocation.RequestedDateTime != nil {
+			title += " at " + invocation.RequestedDateTime.Format(time.RFC3339)
+		}
+
+		var content []string
+		for _, plugin := range invocation.CommandPlugins {
+			content = append(content, aws.ToString(plugin.Output))
+		}
+
+		sections = append(sections, provision.LogSection{
+			Title:   title,
+			Content: strings.Join(content, "\n"),
+		})
+	}
+
+	return sections, nil
+}
+
+// publicIp returns stackIp if it is a public address, otherwise it asks ec2 for the
+// public ip of the instance.
+func (p *AwsProvisioner) publicIp(ctx context.Context, instanceId, stackIp string) (net.IP, error) {
+	ip := net.ParseIP(stackIp)
+	if ip != nil && !ip.IsPrivate() {
+		return ip, nil
+	}
+
+	log.Debug("Stack output has no public ip, asking ec2", "ServerIp", stackIp, "instanceId", instanceId)
+	instances, err := p.ec2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{instanceId},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, reservation := range instances.Reservations {
+		for _, instance := range reservation.Instances {
+			if instance.PublicIpAddress != nil && *instance.PublicIpAddress != "" {
+				return net.ParseIP(*instance.PublicIpAddress), nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("instance %s has no public ip address", instanceId)
+}
+
+// instanceArchitecture returns the architecture of the default image matching instanceType,
+// arm64 for graviton types like t4g and x86_64 otherwise.
+func (p *AwsProvisioner) instanceArchitecture(ctx context.Context, instanceType string) (string, error) {
+	types, err := p.ec2Client.DescribeInstanceTypes(ctx, &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []ec2Types.InstanceType{ec2Types.InstanceType(instanceType)},
+	})
+	if err != nil && strings.Contains(err.Error(), "InvalidInstanceType") {
+		return "", unknownInstanceTypeError(instanceType)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if len(types.InstanceTypes) == 0 || types.InstanceTypes[0].ProcessorInfo == nil {
+		return "", unknownInstanceTypeError(instanceType)
+	}
+
+	architectures := types.InstanceTypes[0].ProcessorInfo.SupportedArchitectures
+	for _, architecture := range architectures {
+		if architecture == ec2Types.ArchitectureTypeX8664 {
+			return string(architecture), nil
+		}
+	}
+	for _, architecture := range architectures {
+		if architecture == ec2Types.ArchitectureTypeArm64 {
+			return string(architecture), nil
+		}
+	}
+
+	return "", fmt.Errorf("instance type %s has no supported architecture: %v", instanceType, architectures)
+}
+
+// validateAvailabilityZone checks that zone is an available zone of the configured region.
+func (p *AwsProvisioner) validateAvailabilityZone(ctx context.Context, zone string) error {
+	zones, err := p.ec2Client.DescribeAvailabilityZones(ctx, &ec2.DescribeAvailabilityZonesInput{})
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, z := range zones.AvailabilityZones {
+		if z.ZoneName == nil {
+			continue
+		}
+		if *z.ZoneName == zone {
+			if z.State != ec2Types.AvailabilityZoneStateAvailable {
+				return fmt.Errorf("availability zone %s is %s", zone, z.State)
+			}
+			return nil
+		}
+		names = append(names, *z.ZoneName)
+	}
+
+	return fmt.Errorf("availability zone %s not found in region %s, available: %s", zone, p.ec2Client.Options().Region, strings.Join(names, ", "))
+}
+
+// EstimateCost does not know the price, without args.InstanceType the instance type
+// is chosen by the template.
+func (p *AwsProvisioner) EstimateCost(ctx context.Context, args provision.ProvisionArguments) (provision.CostEstimate, error) {
+	return provision.CostEstimate{InstanceType: args.InstanceType}, nil
+}
+
+// stackOutputs returns the outputs of an existing stack.
+func (p *AwsProvisioner) stackOutputs(ctx context.Context, stackName string) (map[string]string, error) {
+	resp, err := p.cfClient.DescribeStacks(ctx, &cloudformation.DescribeStacksInput{
+		StackName: pstr(stackName),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Stacks) == 0 {
+		return nil, fmt.Errorf("stack %s not found", stackName)
+	}
+
+	outputParams := map[string]string{}
+	for _, output := range resp.Stacks[0].Outputs {
+		outputParams[*output.OutputKey] = *output.OutputValue
+	}
+
+	return outputParams, nil
+}
+
+func (p *AwsProvisioner) instanceId(ctx context.Context, stackName string) (string, error) {
+	outputs, err := p.stackOutputs(ctx, stackName)
+	if err != nil {
+		return "", err
+	}
+
+	instanceId := outputs["InstanceId"]
+	if instanceId == "" {
+		return "", fmt.Errorf("stack %s has no InstanceId output", stackName)
+	}
+
+	return instanceId, nil
+}
+
+// rateLimitedClient complements the retryer of the sdk by not sending more than the
+// configured requests per second in the first place.
+type rateLimitedClient struct {
+	limiter *provision.RateLimiter
+	client  aws.HTTPClient
+}
+
+func (c *rateLimitedClient) Do(req *http.Request) (*http.Response, error) {
+	err := c.limiter.Wait(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	return c.client.Do(req)
+}
+
 func pstr(s string) *string {
 	return &s
 }
 
+func (p *AwsProvisioner) Name() string {
+	return "aws"
+}
+
 func (p *AwsProvisioner) Locations(ctx context.Context) ([]provision.Location, error) {
-	return locations, nil
+	// the locations are embedded, the cache only hands out copies of them
+	return provision.SharedLocationCache.Get(ctx, p.Name(), func(context.Context) ([]provision.Location, error) {
+		return locations, nil
+	})
 }
 
 func (p *AwsProvisioner) initSdkClients(ctx context.Context, region string) error {
-	cfg, err := config.LoadDefaultConfig(ctx)
+	var optFns []func(*config.LoadOptions) error
+	if p.Credentials != nil {
+		optFns = append(optFns, config.WithCredentialsProvider(p.Credentials))
+	}
+	if p.AssumeRole.TokenProvider != nil {
+		// mfa_serial of profiles in the shared config
+		optFns = append(optFns, config.WithAssumeRoleCredentialOptions(func(o *stscreds.AssumeRoleOptions) {
+			o.TokenProvider = p.AssumeRole.TokenProvider
+		}))
+	}
+	if p.Proxy != "" || p.MaxRps > 0 {
+		proxy, err := provision.HttpProxy(p.Proxy)
+		if err != nil {
+			return err
+		}
+
+		var httpClient aws.HTTPClient = awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+			tr.Proxy = proxy
+		})
+		if p.MaxRps > 0 {
+			httpClient = &rateLimitedClient{
+				limiter: provision.NewRateLimiter(p.MaxRps),
+				client:  httpClient,
+			}
+		}
+
+		optFns = append(optFns, config.WithHTTPClient(httpClient))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, optFns...)
 	if err != nil {
 		return err
 	}
 
 	cfg.Logger = NewAwsLogger(log.Default())
-	cfg.ClientLogMode = aws.LogRequest | aws.LogResponse
+	if p.LogSdkRequests {
+		cfg.ClientLogMode = aws.LogRequest | aws.LogResponse
+	}
 	cfg.Region = region
 
 	p.stsClient = sts.NewFromConfig(cfg)
@@ -507,6 +1665,7 @@ func (p *AwsProvisioner) initSdkClients(ctx context.Context, region string) erro
 	p.ssmClient = ssm.NewFromConfig(cfg)
 	p.s3Client = s3.NewFromConfig(cfg)
 	p.ec2Client = ec2.NewFromConfig(cfg)
+	p.iamClient = iam.NewFromConfig(cfg)
 
-	return nil
+	return p.checkCredentials(ctx)
 }
@@ -162,18 +162,20 @@ var locations = []provision.Location{
 		Key:       "eu-west-3",
 	},
 	{
-		Latitude:  0,
-		Longitude: 0,
-		Country:   "Israel",
-		City:      "Tel Aviv",
-		Key:       "il-central-1",
+		Latitude:           0,
+		Longitude:          0,
+		Country:            "Israel",
+		City:               "Tel Aviv",
+		Key:                "il-central-1",
+		CoordinatesUnknown: true,
 	},
 	{
-		Latitude:  0,
-		Longitude: 0,
-		Country:   "Middle East",
-		City:      "UAE",
-		Key:       "me-central-1",
+		Latitude:           0,
+		Longitude:          0,
+		Country:            "Middle East",
+		City:               "UAE",
+		Key:                "me-central-1",
+		CoordinatesUnknown: true,
 	},
 	{
 		Latitude:  26.225,
@@ -190,25 +192,28 @@ var locations = []provision.Location{
 		Key:       "sa-east-1",
 	},
 	{
-		Latitude:  0,
-		Longitude: 0,
-		Country:   "US East",
-		City:      "N. Virginia",
-		Key:       "us-east-1",
+		Latitude:           0,
+		Longitude:          0,
+		Country:            "US East",
+		City:               "N. Virginia",
+		Key:                "us-east-1",
+		CoordinatesUnknown: true,
 	},
 	{
-		Latitude:  0,
-		Longitude: 0,
-		Country:   "US East",
-		City:      "Ohio",
-		Key:       "us-east-2",
+		Latitude:           0,
+		Longitude:          0,
+		Country:            "US East",
+		City:               "Ohio",
+		Key:                "us-east-2",
+		CoordinatesUnknown: true,
 	},
 	{
-		Latitude:  0,
-		Longitude: 0,
-		Country:   "US West",
-		City:      "N. California",
-		Key:       "us-west-1",
+		Latitude:           0,
+		Longitude:          0,
+		Country:            "US West",
+		City:               "N. California",
+		Key:                "us-west-1",
+		CoordinatesUnknown: true,
 	},
 	{
 		Latitude:  41.6524,
@@ -0,0 +1,164 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	cfTypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// fakeCloudformation keeps the status of a single stack. Methods the tests do not
+// need are left to the nil embedded interface and panic.
+type fakeCloudformation struct {
+	cloudformationClient
+
+	exists  bool
+	status  cfTypes.StackStatus
+	creates int
+	deletes int
+}
+
+func (f *fakeCloudformation) CreateStack(ctx context.Context, params *cloudformation.CreateStackInput, optFns ...func(*cloudformation.Options)) (*cloudformation.CreateStackOutput, error) {
+	f.creates++
+	f.exists = true
+	f.status = cfTypes.StackStatusCreateInProgress
+	return &cloudformation.CreateStackOutput{}, nil
+}
+
+func (f *fakeCloudformation) DeleteStack(ctx context.Context, params *cloudformation.DeleteStackInput, optFns ...func(*cloudformation.Options)) (*cloudformation.DeleteStackOutput, error) {
+	f.deletes++
+	f.status = cfTypes.StackStatusDeleteComplete
+	return &cloudformation.DeleteStackOutput{}, nil
+}
+
+func (f *fakeCloudformation) DescribeStacks(ctx context.Context, params *cloudformation.DescribeStacksInput, optFns ...func(*cloudformation.Options)) (*cloudformation.DescribeStacksOutput, error) {
+	if !f.exists {
+		return &cloudformation.DescribeStacksOutput{}, nil
+	}
+	return &cloudformation.DescribeStacksOutput{
+		Stacks: []cfTypes.Stack{{
+			StackName:   params.StackName,
+			StackStatus: f.status,
+		}},
+	}, nil
+}
+
+func TestResumeExistingStack(t *testing.T) {
+	tests := []struct {
+		name    string
+		exists  bool
+		status  cfTypes.StackStatus
+		creates int
+		deletes int
+	}{
+		{name: "gone", exists: false},
+		{name: "create in progress", exists: true, status: cfTypes.StackStatusCreateInProgress},
+		{name: "update in progress", exists: true, status: cfTypes.StackStatusUpdateInProgress},
+		{name: "delete in progress", exists: true, status: cfTypes.StackStatusDeleteInProgress, creates: 1, deletes: 1},
+		{name: "rollback complete", exists: true, status: cfTypes.StackStatusRollbackComplete, creates: 1, deletes: 1},
+		{name: "create failed", exists: true, status: cfTypes.StackStatusCreateFailed, creates: 1, deletes: 1},
+		{name: "create complete", exists: true, status: cfTypes.StackStatusCreateComplete},
+		{name: "update rollback complete", exists: true, status: cfTypes.StackStatusUpdateRollbackComplete},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cf := &fakeCloudformation{exists: tt.exists, status: tt.status}
+			p := &AwsProvisioner{cfClient: cf}
+
+			err := p.resumeExistingStack(context.Background(), &cloudformation.CreateStackInput{
+				StackName: pstr("wg-ondemand"),
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cf.creates != tt.creates {
+				t.Errorf("got %d creates, want %d", cf.creates, tt.creates)
+			}
+			if cf.deletes != tt.deletes {
+				t.Errorf("got %d deletes, want %d", cf.deletes, tt.deletes)
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	t.Run("succeeds", func(t *testing.T) {
+		calls := 0
+		err := retry(context.Background(), 5, 0, func() error {
+			calls++
+			if calls < 3 {
+				return errFailed
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if calls != 3 {
+			t.Errorf("got %d calls, want 3", calls)
+		}
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		calls := 0
+		err := retry(context.Background(), 3, 0, func() error {
+			calls++
+			return errFailed
+		})
+		if !errors.Is(err, errFailed) {
+			t.Errorf("got %v, want it to wrap %v", err, errFailed)
+		}
+		if !strings.Contains(err.Error(), "after 3 attempts") {
+			t.Errorf("got %q, want the attempts in the error", err)
+		}
+		if calls != 3 {
+			t.Errorf("got %d calls, want 3", calls)
+		}
+	})
+
+	t.Run("cancelled before", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		calls := 0
+		err := retry(ctx, 3, 0, func() error {
+			calls++
+			return nil
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, want %v", err, context.Canceled)
+		}
+		if calls != 0 {
+			t.Errorf("got %d calls, want 0", calls)
+		}
+	})
+
+	t.Run("cancelled during the delay", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		calls := 0
+		start := time.Now()
+		err := retry(ctx, 3, time.Hour, func() error {
+			calls++
+			time.AfterFunc(10*time.Millisecond, cancel)
+			return errFailed
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, want %v", err, context.Canceled)
+		}
+		if calls != 1 {
+			t.Errorf("got %d calls, want 1", calls)
+		}
+		if elapsed := time.Since(start); elapsed > time.Minute {
+			t.Errorf("the delay was not interrupted, took %s", elapsed)
+		}
+	})
+}
@@ -2,14 +2,19 @@ package aws
 
 import (
 	"archive/zip"
-	"bytes"
 	"context"
 	"embed"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
@@ -78,19 +83,155 @@ type ManifestArtifact struct {
 	} `json:"properties"`
 }
 
+// AssumeRoleOptions are added to the assume role calls of the emulated cdk deploy.
+type AssumeRoleOptions struct {
+	// RoleSessionName overrides the default session names if set.
+	RoleSessionName string
+	// ExternalId is required by roles whose trust policy has an sts:ExternalId condition.
+	ExternalId string
+	// MfaSerial is the serial number or arn of the mfa device, for roles requiring mfa.
+	MfaSerial string
+	// TokenProvider returns the current mfa code. It is called for every assume role
+	// call, one at a time, and also used for mfa profiles of the shared config.
+	TokenProvider func() (string, error)
+}
+
+// tokenMutex serializes TokenProvider calls, the concurrent asset uploads must not
+// prompt for codes at the same time.
+var tokenMutex sync.Mutex
+
+func (o AssumeRoleOptions) input(roleArn, defaultSessionName string) (*sts.AssumeRoleInput, error) {
+	input := &sts.AssumeRoleInput{
+		RoleArn:         pstr(roleArn),
+		RoleSessionName: pstr(defaultSessionName),
+	}
+	if o.RoleSessionName != "" {
+		input.RoleSessionName = pstr(o.RoleSessionName)
+	}
+	if o.ExternalId != "" {
+		input.ExternalId = pstr(o.ExternalId)
+	}
+	if o.MfaSerial != "" {
+		if o.TokenProvider == nil {
+			return nil, errors.New("mfa serial is set but no token provider")
+		}
+
+		tokenMutex.Lock()
+		token, err := o.TokenProvider()
+		tokenMutex.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get mfa token: %w", err)
+		}
+
+		input.SerialNumber = pstr(o.MfaSerial)
+		input.TokenCode = pstr(token)
+	}
+	return input, nil
+}
+
 type cdkEmulateState struct {
-	stsClient *sts.Client
+	stsClient       *sts.Client
+	assumeRole      AssumeRoleOptions
+	partConcurrency int
 }
 
-// EmulateCdk emulates the behavior of the AWS CDK CLI by uploading assets to S3
-func EmulateCdk(ctx context.Context, stsClient *sts.Client) error {
-	var c cdkEmulateState
-	c.stsClient = stsClient
+// EmulateCdk emulates the behavior of the AWS CDK CLI by uploading assets to S3.
+// Large assets are uploaded in parts, partConcurrency per asset at a time.
+func EmulateCdk(ctx context.Context, stsClient *sts.Client, assumeRole AssumeRoleOptions, partConcurrency int) error {
+	c := cdkEmulateState{
+		stsClient:       stsClient,
+		assumeRole:      assumeRole,
+		partConcurrency: partConcurrency,
+	}
 	return c.uploadAssets(ctx)
 }
 
+// cdkRoleArns returns the bootstrap roles the emulated cdk deploy has to assume.
+func cdkRoleArns(ctx context.Context, stsClient *sts.Client) ([]string, error) {
+	c := cdkEmulateState{stsClient: stsClient}
+
+	manifestJson, err := c.loadManifestJson()
+	if err != nil {
+		return nil, err
+	}
+
+	assetManifestJson, err := c.loadAssetManifestJson()
+	if err != nil {
+		return nil, err
+	}
+
+	var roleArns []string
+	for _, artifact := range manifestJson.Artifacts {
+		if artifact.Type == "aws:cloudformation:stack" && artifact.Properties.AssumeRoleArn != "" {
+			roleArns = append(roleArns, artifact.Properties.AssumeRoleArn)
+		}
+	}
+
+	for _, file := range assetManifestJson.Files {
+		for _, destination := range file.Destinations {
+			roleArns = append(roleArns, destination.AssumeRoleArn)
+		}
+	}
+
+	return roleArns, nil
+}
+
+// cdkAssetBuckets returns the buckets the embedded cdk.out uploads its assets to.
+// stsClient expands the aws variables of the manifest.
+func cdkAssetBuckets(ctx context.Context, stsClient *sts.Client) ([]string, error) {
+	c := cdkEmulateState{stsClient: stsClient}
+
+	assetManifestJson, err := c.loadAssetManifestJson()
+	if err != nil {
+		return nil, err
+	}
+
+	var buckets []string
+	for _, file := range assetManifestJson.Files {
+		for _, destination := range file.Destinations {
+			if !slices.Contains(buckets, destination.BucketName) {
+				buckets = append(buckets, destination.BucketName)
+			}
+		}
+	}
+
+	return buckets, nil
+}
+
+// bootstrapRequirement is the minimal bootstrap version the embedded cdk.out needs and
+// the ssm parameter the bootstrap stack publishes its version in.
+type bootstrapRequirement struct {
+	Version      int
+	SsmParameter string
+}
+
+// requiredBootstrapVersion returns the highest bootstrap version any artifact of the
+// embedded cdk.out requires. stsClient expands the aws variables of the manifest.
+func requiredBootstrapVersion(stsClient *sts.Client) (bootstrapRequirement, error) {
+	c := cdkEmulateState{stsClient: stsClient}
+
+	manifestJson, err := c.loadManifestJson()
+	if err != nil {
+		return bootstrapRequirement{}, err
+	}
+
+	var requirement bootstrapRequirement
+	for _, artifact := range manifestJson.Artifacts {
+		if artifact.Properties.RequiresBootstrapStackVersion > requirement.Version && artifact.Properties.BootstrapStackVersionSsmParameter != "" {
+			requirement.Version = artifact.Properties.RequiresBootstrapStackVersion
+			requirement.SsmParameter = artifact.Properties.BootstrapStackVersionSsmParameter
+		}
+	}
+
+	return requirement, nil
+}
+
 func (c *cdkEmulateState) uploadAssets(ctx context.Context) error {
-	manifestJson := c.loadManifestJson()
+	manifestJson, err := c.loadManifestJson()
+	if err != nil {
+		return err
+	}
+
 	var stackAssumeRole string
 	for _, artifact := range manifestJson.Artifacts {
 		if artifact.Type == "aws:cloudformation:stack" {
@@ -99,61 +240,82 @@ func (c *cdkEmulateState) uploadAssets(ctx context.Context) error {
 		}
 	}
 
-	err := c.assumeRoleStsClient(ctx, stackAssumeRole, func(stsClient *sts.Client) error {
-		c.innerUploadAssets(ctx, stsClient)
-		return nil
+	err = c.assumeRoleStsClient(ctx, stackAssumeRole, func(stsClient *sts.Client) error {
+		return c.innerUploadAssets(ctx, stsClient)
 	})
 
 	return err
 }
 
-func (c *cdkEmulateState) innerUploadAssets(ctx context.Context, stsClient *sts.Client) {
-	assetManifestJson := c.loadAssetManifestJson()
-	for _, file := range assetManifestJson.Files {
-		assetFile, err := c.packageFilesToUpload(file.Source.Packaging, file.Source.Path)
-		if err != nil {
-			log.Error("Failed to package files", "err", err)
-			continue
-		}
+const (
+	assetUploadTimeout     = 5 * time.Minute
+	assetUploadConcurrency = 4
+)
 
+func (c *cdkEmulateState) innerUploadAssets(ctx context.Context, stsClient *sts.Client) error {
+	assetManifestJson, err := c.loadAssetManifestJson()
+	if err != nil {
+		return err
+	}
+
+	wg := sync.WaitGroup{}
+	semaphore := make(chan struct{}, assetUploadConcurrency)
+	errsMutex := sync.Mutex{}
+	var errs []error
+	addError := func(err error) {
+		errsMutex.Lock()
+		defer errsMutex.Unlock()
+		errs = append(errs, err)
+	}
+
+	for _, file := range assetManifestJson.Files {
 		for _, destination := range file.Destinations {
-			err = c.assumeRoleS3Client(ctx, stsClient, destination.AssumeRoleArn, func(s3Client *s3.Client) error {
-				log.Info("Uploading asset", "bucketName", destination.BucketName, "objectKey", destination.ObjectKey)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
 
-				_, err := s3Client.PutObject(ctx, &s3.PutObjectInput{
-					Bucket: &destination.BucketName,
-					Key:    &destination.ObjectKey,
-					Body:   strings.NewReader(string(assetFile)),
-				})
+				semaphore <- struct{}{}
+				defer func() { <-semaphore }()
 
-				return err
-			})
+				uploadCtx, cancel := context.WithTimeout(ctx, assetUploadTimeout)
+				defer cancel()
 
-			if err != nil {
-				log.Error("Failed to upload asset", "err", err)
-			}
+				err := c.assumeRoleS3Client(uploadCtx, stsClient, destination.AssumeRoleArn, func(s3Client *s3.Client) error {
+					// every destination gets its own stream, the asset is never held in memory as a whole
+					asset, err := c.openAsset(file.Source.Packaging, file.Source.Path)
+					if err != nil {
+						return fmt.Errorf("package %s: %w", file.Source.Path, err)
+					}
+					defer asset.Close()
+
+					log.Info("Uploading asset", "bucketName", destination.BucketName, "objectKey", destination.ObjectKey)
+
+					return uploadObject(uploadCtx, s3Client, destination.BucketName, destination.ObjectKey, asset, c.partConcurrency)
+				})
+
+				if err != nil {
+					log.Error("Failed to upload asset", "err", err)
+					addError(fmt.Errorf("upload %s/%s: %w", destination.BucketName, destination.ObjectKey, err))
+				}
+			}()
 		}
 	}
+
+	wg.Wait()
+
+	return errors.Join(errs...)
 }
 
-func (c *cdkEmulateState) packageFilesToUpload(packingType, path string) ([]byte, error) {
-	var assetFile []byte
-	var err error
-	if packingType == "zip" {
-		assetFile, err = c.zipDirContent("cdk.out/" + path)
-		if err != nil {
-			return nil, err
-		}
-	} else if packingType == "file" {
-		assetFile, err = cdkOut.ReadFile("cdk.out/" + path)
-		if err != nil {
-			return nil, err
-		}
-	} else {
+// openAsset returns the packaged asset as a stream.
+func (c *cdkEmulateState) openAsset(packingType, path string) (io.ReadCloser, error) {
+	switch packingType {
+	case "zip":
+		return c.zipDirContent("cdk.out/" + path), nil
+	case "file":
+		return cdkOut.Open("cdk.out/" + path)
+	default:
 		return nil, errors.New("unknown packing type")
 	}
-
-	return assetFile, nil
 }
 
 func expandAwsVariables(ctx context.Context, stsClient *sts.Client, s string) string {
@@ -181,42 +343,49 @@ func expandAwsVariables(ctx context.Context, stsClient *sts.Client, s string) st
 	})
 }
 
-func (c *cdkEmulateState) zipDirContent(dir string) ([]byte, error) {
-	var buf bytes.Buffer
-	zipWriter := zip.NewWriter(&buf)
-	defer zipWriter.Close()
+// zipDirContent streams a zip of dir, written by a goroutine as the reader consumes it.
+// The zip is deterministic, walkDir visits entries sorted by name and no modification
+// times are set, so the asset hash stays stable across runs.
+func (c *cdkEmulateState) zipDirContent(dir string) io.ReadCloser {
+	pipeReader, pipeWriter := io.Pipe()
 
-	err := c.walkDir(cdkOut, dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	go func() {
+		zipWriter := zip.NewWriter(pipeWriter)
 
-		if info.IsDir() {
-			return nil
-		}
+		err := c.walkDir(cdkOut, dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
 
-		fileBytes, err := cdkOut.ReadFile(path)
-		if err != nil {
-			return err
-		}
+			if info.IsDir() {
+				return nil
+			}
 
-		zipFilePath := strings.TrimPrefix(path, dir+"/")
-		zipFile, err := zipWriter.Create(zipFilePath)
-		if err != nil {
-			return err
-		}
+			file, err := cdkOut.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
 
-		_, err = zipFile.Write(fileBytes)
-		return err
-	})
+			zipFilePath := strings.TrimPrefix(path, dir+"/")
+			zipFile, err := zipWriter.Create(zipFilePath)
+			if err != nil {
+				return err
+			}
 
-	if err != nil {
-		return nil, err
-	}
+			_, err = io.Copy(zipFile, file)
+			return err
+		})
 
-	zipWriter.Close()
+		if err == nil {
+			err = zipWriter.Close()
+		}
+
+		// a nil error closes the pipe with io.EOF
+		pipeWriter.CloseWithError(err)
+	}()
 
-	return buf.Bytes(), nil
+	return pipeReader
 }
 
 func (c *cdkEmulateState) walkDir(fs embed.FS, dir string, cb func(path string, info os.FileInfo, err error) error) error {
@@ -249,11 +418,13 @@ func (c *cdkEmulateState) walkDir(fs embed.FS, dir string, cb func(path string,
 }
 
 func (c *cdkEmulateState) assumeRoleS3Client(ctx context.Context, stsClient *sts.Client, roleArn string, cb func(s3Client *s3.Client) error) error {
+	input, err := c.assumeRole.input(roleArn, "wg-ondemand-asset-upload")
+	if err != nil {
+		return err
+	}
+
 	var innerErr error
-	_, err := stsClient.AssumeRole(ctx, &sts.AssumeRoleInput{
-		RoleArn:         pstr(roleArn),
-		RoleSessionName: pstr("wg-ondemand-asset-upload"),
-	}, func(req *sts.Options) {
+	_, err = stsClient.AssumeRole(ctx, input, func(req *sts.Options) {
 		s3Client := s3.NewFromConfig(aws.Config{
 			Credentials: req.Credentials,
 			Region:      stsClient.Options().Region,
@@ -271,11 +442,13 @@ func (c *cdkEmulateState) assumeRoleS3Client(ctx context.Context, stsClient *sts
 
 func (c *cdkEmulateState) assumeRoleStsClient(ctx context.Context, roleArn string, cb func(s3Client *sts.Client) error) error {
 	log.Info("Assuming role", "roleArn", roleArn)
+	input, err := c.assumeRole.input(roleArn, "wg-ondemand-deploy")
+	if err != nil {
+		return err
+	}
+
 	var innerErr error
-	_, err := c.stsClient.AssumeRole(ctx, &sts.AssumeRoleInput{
-		RoleArn:         pstr(roleArn),
-		RoleSessionName: pstr("wg-ondemand-deploy"),
-	}, func(req *sts.Options) {
+	_, err = c.stsClient.AssumeRole(ctx, input, func(req *sts.Options) {
 		deeperStsClient := sts.NewFromConfig(aws.Config{
 			Credentials: req.Credentials,
 			Region:      c.stsClient.Options().Region,
@@ -291,8 +464,12 @@ func (c *cdkEmulateState) assumeRoleStsClient(ctx context.Context, roleArn strin
 	return innerErr
 }
 
-func (c *cdkEmulateState) loadAssetManifestJson() (assetManifestJson StackAssetJson) {
-	manifestJson := c.loadManifestJson()
+func (c *cdkEmulateState) loadAssetManifestJson() (assetManifestJson StackAssetJson, err error) {
+	manifestJson, err := c.loadManifestJson()
+	if err != nil {
+		return assetManifestJson, err
+	}
+
 	var assetPath string
 	for _, artifact := range manifestJson.Artifacts {
 		if artifact.Type == "cdk:asset-manifest" {
@@ -301,26 +478,70 @@ func (c *cdkEmulateState) loadAssetManifestJson() (assetManifestJson StackAssetJ
 		}
 	}
 
-	c.loadCdkOutFile("cdk.out/"+assetPath, &assetManifestJson)
+	if assetPath == "" {
+		return assetManifestJson, errors.New("embedded cdk.out manifest has no cdk:asset-manifest artifact")
+	}
+
+	err = c.loadCdkOutFile("cdk.out/"+assetPath, &assetManifestJson)
 	return
 }
 
-func (c *cdkEmulateState) loadManifestJson() (manifestJson ManifestJson) {
-	c.loadCdkOutFile("cdk.out/manifest.json", &manifestJson)
+// the cloud assembly schema major versions the emulation has been tested with
+const (
+	minManifestMajorVersion = 34
+	maxManifestMajorVersion = 38
+)
+
+func (c *cdkEmulateState) loadManifestJson() (manifestJson ManifestJson, err error) {
+	err = c.loadCdkOutFile("cdk.out/manifest.json", &manifestJson)
+	if err != nil {
+		return
+	}
+
+	err = checkManifestVersion(manifestJson.Version)
+	if err != nil {
+		return
+	}
+
+	for name, artifact := range manifestJson.Artifacts {
+		if artifact.Type != "cdk:asset-manifest" && artifact.Type != "aws:cloudformation:stack" {
+			log.Debug("Ignoring unsupported cdk artifact", "name", name, "type", artifact.Type)
+		}
+	}
+
 	return
 }
 
-func (c *cdkEmulateState) loadCdkOutFile(path string, out any) {
+func checkManifestVersion(version string) error {
+	majorStr, _, _ := strings.Cut(version, ".")
+	major, err := strconv.Atoi(majorStr)
+	if err != nil {
+		return fmt.Errorf("invalid cdk manifest version %q", version)
+	}
+
+	if major < minManifestMajorVersion {
+		return fmt.Errorf("cdk manifest version %s is older than the supported %d.x", version, minManifestMajorVersion)
+	}
+
+	if major > maxManifestMajorVersion {
+		log.Warn("cdk manifest version is newer than tested, some fields may be ignored", "version", version, "maxTested", maxManifestMajorVersion)
+	}
+
+	return nil
+}
+
+func (c *cdkEmulateState) loadCdkOutFile(path string, out any) error {
 	fileBytes, err := cdkOut.ReadFile(path)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to read embedded %s: %w", path, err)
 	}
 
 	fileBytes = []byte(expandAwsVariables(context.Background(), c.stsClient, string(fileBytes)))
 
 	err = json.Unmarshal(fileBytes, &out)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to parse embedded %s: %w", path, err)
 	}
 
+	return nil
 }
@@ -0,0 +1,45 @@
+package aws
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/charmbracelet/log"
+)
+
+func TestCheckManifestVersion(t *testing.T) {
+	tests := []struct {
+		version  string
+		wantErr  bool
+		wantWarn bool
+	}{
+		{version: fmt.Sprintf("%d.0.0", minManifestMajorVersion)},
+		{version: fmt.Sprintf("%d.1.0", maxManifestMajorVersion)},
+		{version: fmt.Sprintf("%d.0.0", minManifestMajorVersion-1), wantErr: true},
+		{version: fmt.Sprintf("%d.0.0", maxManifestMajorVersion+1), wantWarn: true},
+		{version: "invalid", wantErr: true},
+	}
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			output.Reset()
+
+			err := checkManifestVersion(tt.version)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+
+			warned := strings.Contains(output.String(), "newer than tested")
+			if warned != tt.wantWarn {
+				t.Errorf("got warning %v, want warning %v: %q", warned, tt.wantWarn, output.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// checkCredentials probes the credentials with GetCallerIdentity, which needs no
+// permissions, so unusable credentials fail with a hint instead of an sdk error in the
+// middle of an operation. Once they passed they are not probed again.
+func (p *AwsProvisioner) checkCredentials(ctx context.Context) error {
+	if p.credentialsChecked {
+		return nil
+	}
+
+	_, err := p.stsClient.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return credentialsError(err)
+	}
+	p.credentialsChecked = true
+	return nil
+}
+
+// credentialsError wraps a failed credentials probe with how to fix the cause.
+func credentialsError(err error) error {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "ExpiredToken") || strings.Contains(msg, "RequestExpired") || strings.Contains(msg, "SSO token"):
+		return fmt.Errorf("aws credentials expired, renew them, e.g. with aws sso login or new session credentials: %w", err)
+	case strings.Contains(msg, "InvalidClientTokenId") || strings.Contains(msg, "SignatureDoesNotMatch") || strings.Contains(msg, "UnrecognizedClient"):
+		return fmt.Errorf("aws credentials are invalid, check the access key and secret or whether the key was deactivated: %w", err)
+	case strings.Contains(msg, "AccessDenied"):
+		return fmt.Errorf("aws credentials lack permissions, sts:GetCallerIdentity is denied by a policy or service control policy: %w", err)
+	case strings.Contains(msg, "failed to retrieve credentials") || strings.Contains(msg, "failed to refresh cached credentials") || strings.Contains(msg, "get credentials"):
+		return fmt.Errorf("no aws credentials found, configure them with aws configure, AWS_PROFILE or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY: %w", err)
+	default:
+		return fmt.Errorf("checking aws credentials: %w", err)
+	}
+}
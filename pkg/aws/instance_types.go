@@ -0,0 +1,40 @@
+package aws
+
+import (
+	"fmt"
+
+	"github.com/schidstorm/wg-ondemand/pkg/provision"
+)
+
+// instanceFamilies and instanceSizes span the instance types a vpn server is typically
+// run on. Not every combination exists, the list only serves typo suggestions while
+// DescribeInstanceTypes decides which types are valid.
+var (
+	instanceFamilies = []string{
+		"t2", "t3", "t3a", "t4g",
+		"m5", "m5a", "m6a", "m6g", "m6i", "m7a", "m7g", "m7i",
+		"c5", "c5a", "c5n", "c6a", "c6g", "c6gn", "c6i", "c6in", "c7a", "c7g", "c7gn", "c7i",
+		"r5", "r5a", "r6a", "r6g", "r6i", "r7a", "r7g", "r7i",
+	}
+	instanceSizes = []string{"nano", "micro", "small", "medium", "large", "xlarge", "2xlarge", "4xlarge", "8xlarge"}
+)
+
+// knownInstanceTypes returns every combination of instanceFamilies and instanceSizes.
+func knownInstanceTypes() []string {
+	var instanceTypes []string
+	for _, family := range instanceFamilies {
+		for _, size := range instanceSizes {
+			instanceTypes = append(instanceTypes, family+"."+size)
+		}
+	}
+	return instanceTypes
+}
+
+// unknownInstanceTypeError reports instanceType as unknown, with the closest known type
+// if it looks like a typo.
+func unknownInstanceTypeError(instanceType string) error {
+	if match := provision.ClosestMatch(instanceType, knownInstanceTypes()); match != "" {
+		return fmt.Errorf("unknown instance type %s, did you mean %s?", instanceType, match)
+	}
+	return fmt.Errorf("unknown instance type %s", instanceType)
+}
@@ -0,0 +1,25 @@
+package aws
+
+import (
+	"context"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// uploadObject streams body to s3 with the upload manager, which switches to a multipart
+// upload with up to concurrency parts in flight for large bodies and aborts it on failure.
+// Only the parts in flight are held in memory. concurrency below 1 means 1.
+func uploadObject(ctx context.Context, s3Client *s3.Client, bucket, key string, body io.Reader, concurrency int) error {
+	uploader := manager.NewUploader(s3Client, func(u *manager.Uploader) {
+		u.Concurrency = max(concurrency, 1)
+	})
+
+	_, err := uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: pstr(bucket),
+		Key:    pstr(key),
+		Body:   body,
+	})
+	return err
+}
@@ -0,0 +1,46 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// cloudformation propagates stack tags to all resources, so the ec2 constraints apply
+var tagCharsRegex = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
+
+const (
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+	maxTags           = 50
+)
+
+// validateTags checks tags against the aws tag constraints.
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("too many tags: %d, aws allows at most %d", len(tags), maxTags)
+	}
+
+	var errs []error
+	for k, v := range tags {
+		switch {
+		case k == "" || utf8.RuneCountInString(k) > maxTagKeyLength:
+			errs = append(errs, fmt.Errorf("invalid tag key %q: must be 1 to %d characters", k, maxTagKeyLength))
+		case strings.HasPrefix(strings.ToLower(k), "aws:"):
+			errs = append(errs, fmt.Errorf("invalid tag key %q: the aws: prefix is reserved", k))
+		case !tagCharsRegex.MatchString(k):
+			errs = append(errs, fmt.Errorf("invalid tag key %q: allowed are letters, numbers, spaces and _ . : / = + - @", k))
+		}
+
+		switch {
+		case utf8.RuneCountInString(v) > maxTagValueLength:
+			errs = append(errs, fmt.Errorf("invalid value of tag %q: must be at most %d characters", k, maxTagValueLength))
+		case !tagCharsRegex.MatchString(v):
+			errs = append(errs, fmt.Errorf("invalid value of tag %q: allowed are letters, numbers, spaces and _ . : / = + - @", k))
+		}
+	}
+
+	return errors.Join(errs...)
+}
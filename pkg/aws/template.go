@@ -0,0 +1,102 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/schidstorm/wg-ondemand/pkg/provision"
+	"gopkg.in/yaml.v3"
+)
+
+// the deployment reads these from every template, embedded or user provided
+var (
+	requiredTemplateParameters = []string{"WgPort"}
+	requiredTemplateOutputs    = []string{"InstanceId", "ServerIp"}
+)
+
+// stackTemplate is the part of a cloudformation template the provisioner relies on.
+// yaml nodes keep the intrinsic function tags like !Ref from failing the parse.
+type stackTemplate struct {
+	Parameters map[string]yaml.Node `yaml:"Parameters"`
+	Outputs    map[string]yaml.Node `yaml:"Outputs"`
+}
+
+// parseTemplate parses a json or yaml template and checks that it declares the
+// parameters and outputs the provisioner needs.
+func parseTemplate(body string) (stackTemplate, error) {
+	var template stackTemplate
+	err := yaml.Unmarshal([]byte(body), &template)
+	if err != nil {
+		return stackTemplate{}, fmt.Errorf("invalid template: %w", err)
+	}
+
+	var errs []error
+	for _, parameter := range requiredTemplateParameters {
+		if _, ok := template.Parameters[parameter]; !ok {
+			errs = append(errs, fmt.Errorf("template does not declare the parameter %s", parameter))
+		}
+	}
+	for _, output := range requiredTemplateOutputs {
+		if _, ok := template.Outputs[output]; !ok {
+			errs = append(errs, fmt.Errorf("template does not declare the output %s", output))
+		}
+	}
+
+	return template, errors.Join(errs...)
+}
+
+// checkArguments fails for deploy arguments that are passed as stack parameters the
+// template does not declare. The embedded template declares none of them, they only
+// work with a --template that does.
+func (t stackTemplate) checkArguments(args provision.ProvisionArguments) error {
+	arguments := []struct {
+		flag       string
+		set        bool
+		parameters []string
+	}{
+		{"--ami-id", args.AmiId != "", []string{"AmiId"}},
+		{"--availability-zone", args.AvailabilityZone != "", []string{"AvailabilityZone"}},
+		{"--volume-size", args.VolumeSize > 0, []string{"VolumeSize"}},
+		{"--instance-profile-arn", args.InstanceProfileArn != "", []string{"InstanceProfileArn"}},
+		{"--instance-type", args.InstanceType != "", []string{"InstanceType", "Architecture"}},
+		{"--port-range", args.WgPortRange != nil, []string{"WgPortRangeStart", "WgPortRangeEnd"}},
+		{"--open-port", len(args.OpenPorts) > 0, []string{"ExtraIngressRules"}},
+	}
+
+	var errs []error
+	for _, argument := range arguments {
+		if !argument.set {
+			continue
+		}
+		var missing []string
+		for _, parameter := range argument.parameters {
+			if _, ok := t.Parameters[parameter]; !ok {
+				missing = append(missing, parameter)
+			}
+		}
+		if len(missing) > 0 {
+			errs = append(errs, fmt.Errorf("%s is unsupported on aws: the template does not declare the parameters %v, pass a --template that does", argument.flag, missing))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkParameters fails if params contains parameters the template does not declare,
+// cloudformation would reject the stack otherwise.
+func (t stackTemplate) checkParameters(params map[string]string) error {
+	var unknown []string
+	for key := range params {
+		if _, ok := t.Parameters[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("template does not declare the parameters %v", unknown)
+	}
+
+	return nil
+}
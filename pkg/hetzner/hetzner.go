@@ -4,52 +4,252 @@ import (
 	"bytes"
 	"context"
 	"crypto/ed25519"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"net"
 
 	"github.com/charmbracelet/log"
 	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/schidstorm/wg-ondemand/pkg/metrics"
 	"github.com/schidstorm/wg-ondemand/pkg/provision"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 const sshPort = 22
 
+// defaultSshUser is the user of the rocky-9 image the keys are deployed for.
+const defaultSshUser = "root"
+
+// sshUserRegex matches portable linux user names, which are safe to use in commands.
+var sshUserRegex = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+const defaultServerType = "cx22"
+
+const firewallDeleteAttempts = 15
+
+// firewallDeleteRetryDelay is a variable so tests do not have to wait for it.
+var firewallDeleteRetryDelay = 2 * time.Second
+
+// minVolumeSize is the smallest hetzner volume in GB.
+const minVolumeSize = 10
+
+const (
+	defaultSshTimeout       = 30 * time.Second
+	defaultSshReadyAttempts = 60
+	defaultSshReadyInterval = 5 * time.Second
+)
+
+// KnownLocations is a static list of hetzner locations for when the api can not be
+// queried, e.g. for shell completion without a token.
+var KnownLocations = []provision.Location{
+	{Latitude: 50.47612, Longitude: 12.370071, Country: "DE", City: "Falkenstein", Key: "fsn1"},
+	{Latitude: 49.452102, Longitude: 11.076665, Country: "DE", City: "Nuremberg", Key: "nbg1"},
+	{Latitude: 60.169855, Longitude: 24.938379, Country: "FI", City: "Helsinki", Key: "hel1"},
+	{Latitude: 39.045821, Longitude: -77.487073, Country: "US", City: "Ashburn, VA", Key: "ash"},
+	{Latitude: 45.54222, Longitude: -122.951924, Country: "US", City: "Hillsboro, OR", Key: "hil"},
+	{Latitude: 1.283333, Longitude: 103.833333, Country: "SG", City: "Singapore", Key: "sin"},
+}
+
+// TokenProvider supplies the Hetzner Cloud API token.
+type TokenProvider interface {
+	Token() (string, error)
+}
+
+// EnvTokenProvider reads the token from the HCLOUD_TOKEN environment variable.
+type EnvTokenProvider struct{}
+
+func (EnvTokenProvider) Token() (string, error) {
+	token := os.Getenv("HCLOUD_TOKEN")
+	if token == "" {
+		return "", fmt.Errorf("HCLOUD_TOKEN not set")
+	}
+	return token, nil
+}
+
+// StaticTokenProvider returns a fixed token.
+type StaticTokenProvider string
+
+func (t StaticTokenProvider) Token() (string, error) {
+	if t == "" {
+		return "", fmt.Errorf("empty hetzner token")
+	}
+	return string(t), nil
+}
+
 type HetznerProvisioner struct {
+	// Credentials supplies the API token. Defaults to EnvTokenProvider.
+	Credentials TokenProvider
+	// Proxy is used for API calls and ssh connections, see provision.DialContext.
+	Proxy string
+	// SshKeyName reuses an ssh key already uploaded to hetzner instead of creating one.
+	// SshPrivateKeyFile has to hold the matching private key.
+	SshKeyName        string
+	SshPrivateKeyFile string
+	// SshBastion, user@host[:port], is the jump host for ssh connections to the server.
+	SshBastion string
+	// SshUser logs into the server, defaults to defaultSshUser. Commands of other users
+	// are run with sudo, which must not ask for a password.
+	SshUser string
+	// SshTimeout bounds connecting and the ssh handshake, defaults to defaultSshTimeout.
+	SshTimeout time.Duration
+	// SshReadyAttempts and SshReadyInterval are the budget for waiting until a new server
+	// accepts ssh connections, default to defaultSshReadyAttempts and defaultSshReadyInterval.
+	SshReadyAttempts int
+	SshReadyInterval time.Duration
+	// MaxRps limits the api requests per second, 0 means unlimited.
+	MaxRps float64
+	// RateLimitMaxWait bounds how long a rate limited api request waits for the limit to
+	// reset before failing, defaults to defaultRateLimitMaxWait. Negative disables waiting.
+	RateLimitMaxWait time.Duration
+
 	client    *hcloud.Client
 	privKey   ed25519.PrivateKey
 	pubKeyPem string
+	signer    ssh.Signer
+	// tokenChecked is set once the token was probed successfully, init runs again for
+	// every operation.
+	tokenChecked bool
 }
 
-func (p *HetznerProvisioner) Provision(ctx context.Context, id string, args provision.ProvisionArguments) (provision.ProvisionResult, error) {
-	err := p.init()
+func (p *HetznerProvisioner) Provision(ctx context.Context, id string, args provision.ProvisionArguments) (_ provision.ProvisionResult, err error) {
+	defer func() {
+		metrics.ObserveOperation("hetzner", "provision", err)
+	}()
+
+	err = p.init(ctx)
+	if err != nil {
+		return provision.ProvisionResult{}, err
+	}
+
+	if args.NoWait && args.ProvisionMethod != provision.ProvisionMethodCloudInit {
+		return provision.ProvisionResult{}, errors.New("not waiting requires the cloud-init provision method")
+	}
+
+	var userData string
+	switch args.ProvisionMethod {
+	case "", provision.ProvisionMethodSsh:
+	case provision.ProvisionMethodCloudInit:
+		userData, err = args.RenderInitScript()
+		if err != nil {
+			return provision.ProvisionResult{}, err
+		}
+	default:
+		return provision.ProvisionResult{}, fmt.Errorf("unsupported provision method for hetzner: %s", args.ProvisionMethod)
+	}
+
+	err = p.validateServerTypes(ctx, serverTypes(args))
+	if err != nil {
+		return provision.ProvisionResult{}, err
+	}
+
+	if args.Datacenter != "" {
+		err = p.validateDatacenter(ctx, args.Datacenter, args.Region, serverTypes(args))
+	} else if args.Region != "" {
+		// without a region hetzner picks the location
+		err = p.validateLocation(ctx, args.Region)
+	}
 	if err != nil {
 		return provision.ProvisionResult{}, err
 	}
 
-	sshKey, err := p.createSshKey(ctx, id)
+	labels := args.ResourceTags()
+	err = validateLabels(labels)
 	if err != nil {
 		return provision.ProvisionResult{}, err
 	}
 
-	firewall, err := p.createOrUpdateFirewall(ctx, id, args.WgPort)
+	if args.VolumeSize != 0 && args.VolumeSize < minVolumeSize {
+		return provision.ProvisionResult{}, fmt.Errorf("invalid volume size %d, hetzner volumes have at least %d GB", args.VolumeSize, minVolumeSize)
+	}
+
+	args.ReportProgress("prepare")
+	var sshKey *hcloud.SSHKey
+	if p.SshKeyName != "" {
+		sshKey, err = p.existingSshKey(ctx)
+		if err != nil {
+			return provision.ProvisionResult{}, err
+		}
+	} else {
+		sshKey, err = p.createSshKey(ctx, id, labels)
+		if err != nil {
+			return provision.ProvisionResult{}, err
+		}
+
+		err = p.savePrivateKey(id)
+		if err != nil {
+			return provision.ProvisionResult{}, err
+		}
+	}
+
+	firewall, err := p.createOrUpdateFirewall(ctx, id, args.FirewallWgPorts(), args.OpenPorts, labels)
 	if err != nil {
 		return provision.ProvisionResult{}, err
 	}
 
-	_, err = p.createOrRecreateServer(ctx, id, args.Region, sshKey, *firewall)
+	args.ReportProgress("create server")
+	phaseStart := time.Now()
+	var createdServer *hcloud.Server
+	var serverType string
+	for _, serverType = range serverTypes(args) {
+		log.Info("Creating server", "server", id, "serverType", serverType)
+		createdServer, err = p.createOrRecreateServer(ctx, id, args.Region, args.Datacenter, serverType, sshKey, *firewall, userData, args.ClientWgIp6 != nil, args.VolumeSize, labels)
+		if err == nil || !(hcloud.IsError(err, hcloud.ErrorCodeResourceUnavailable) || hcloud.IsError(err, hcloud.ErrorCodePlacementError)) {
+			break
+		}
+		log.Warn("Server type unavailable", "serverType", serverType, "err", err)
+	}
 	if err != nil {
 		return provision.ProvisionResult{}, err
 	}
 
+	if args.NoWait {
+		log.Info("Not waiting for the server, use status to check when it is ready", "server", id)
+		return provision.ProvisionResult{
+			ServerIP:     createdServer.PublicNet.IPv4.IP,
+			ServerWgIp:   args.ServerWgIp,
+			InstanceType: serverType,
+		}, nil
+	}
+
+	removeHandler := func() {
+		if args.NoCleanupOnFailure {
+			keyFile := p.SshPrivateKeyFile
+			if keyFile == "" {
+				keyFile, _ = privateKeyFile(id)
+			}
+			log.Warn("Keeping failed server, inspect it with ssh and remove it with delete",
+				"server", id,
+				"ssh", fmt.Sprintf("ssh -i %s %s@%s", keyFile, p.sshUser(), createdServer.PublicNet.IPv4.IP),
+				"initOutput", provision.InitScriptOutputFile)
+			return
+		}
+
+		log.Info("Cleaning up server", "server", id)
+		// cleanup has to run even if ctx was cancelled or its deadline exceeded
+		err := p.deleteServer(context.WithoutCancel(ctx), id)
+		if err != nil {
+			log.Error("Failed to delete server", "err", err)
+		}
+	}
+
+	args.ReportProgress("wait for server")
 	var server *hcloud.Server
 	for {
 		server, _, err = p.client.Server.GetByName(ctx, id)
 		if err != nil {
+			removeHandler()
 			return provision.ProvisionResult{}, err
 		}
 
@@ -57,24 +257,57 @@ func (p *HetznerProvisioner) Provision(ctx context.Context, id string, args prov
 			break
 		}
 
-		time.Sleep(10 * time.Second)
+		if err := sleepContext(ctx, 10*time.Second); err != nil {
+			removeHandler()
+			return provision.ProvisionResult{}, err
+		}
+	}
+
+	readyAttempts, readyInterval := p.SshReadyAttempts, p.SshReadyInterval
+	if readyAttempts <= 0 {
+		readyAttempts = defaultSshReadyAttempts
+	}
+	if readyInterval <= 0 {
+		readyInterval = defaultSshReadyInterval
 	}
 
-	for {
-		res, err := p.runShell(ctx, server, "echo 1")
+	for attempt := 1; ; attempt++ {
+		_, err := p.runShell(ctx, server, "echo 1")
 		if err == nil {
 			break
 		}
 
-		log.Info("waiting for server to be ready", "res", string(res))
-		time.Sleep(5 * time.Second)
+		if attempt >= readyAttempts {
+			removeHandler()
+			return provision.ProvisionResult{}, fmt.Errorf("server not reachable via ssh after %d attempts: %w", attempt, err)
+		}
+
+		log.Info("waiting for server to be ready", "attempt", attempt, "err", err)
+		if err := sleepContext(ctx, readyInterval); err != nil {
+			removeHandler()
+			return provision.ProvisionResult{}, err
+		}
 	}
 
-	outputParams, err := args.RunInitScript(ctx, func(script string) (string, error) {
+	metrics.ObservePhase("hetzner", "server", phaseStart)
+
+	runShellFunc := func(script string) (string, error) {
 		stdout, err := p.runShell(ctx, server, script)
 		return string(stdout), err
-	})
+	}
+
+	args.ReportProgress("init script")
+	phaseStart = time.Now()
+	var outputParams *provision.RunInitScriptOutput
+	if userData != "" {
+		log.Info("waiting for cloud-init to run init script")
+		outputParams, err = provision.WaitForInitScriptOutput(ctx, 10*time.Minute, runShellFunc)
+	} else {
+		outputParams, err = args.RunInitScript(ctx, runShellFunc)
+	}
+	metrics.ObservePhase("hetzner", "init_script", phaseStart)
 	if err != nil {
+		removeHandler()
 		return provision.ProvisionResult{}, err
 	}
 
@@ -82,10 +315,113 @@ func (p *HetznerProvisioner) Provision(ctx context.Context, id string, args prov
 		ServerIP:        server.PublicNet.IPv4.IP,
 		ServerWgIp:      args.ServerWgIp,
 		ServerPublicKey: string(outputParams.ServerWgPublicKey),
+		InterfaceName:   outputParams.InterfaceName,
+		InstanceType:    serverType,
+		VolumeMountPath: outputParams.VolumeMountPath,
+		ServerConfig:    outputParams.ServerConfig,
 	}, nil
 }
 
-func (p *HetznerProvisioner) createSshKey(ctx context.Context, name string) (*hcloud.SSHKey, error) {
+func (p *HetznerProvisioner) validateLocation(ctx context.Context, region string) error {
+	hetznerLocations, err := p.client.Location.All(ctx)
+	if err != nil {
+		return err
+	}
+
+	var validKeys []string
+	for _, loc := range hetznerLocations {
+		if loc.Name == region {
+			return nil
+		}
+		validKeys = append(validKeys, loc.Name)
+	}
+
+	return fmt.Errorf("invalid hetzner location %q, valid locations: %s", region, strings.Join(validKeys, ", "))
+}
+
+// validateServerTypes checks that all serverTypes exist, suggesting the closest one on a typo.
+func (p *HetznerProvisioner) validateServerTypes(ctx context.Context, serverTypes []string) error {
+	hetznerServerTypes, err := p.client.ServerType.All(ctx)
+	if err != nil {
+		return err
+	}
+
+	var validNames []string
+	for _, t := range hetznerServerTypes {
+		validNames = append(validNames, t.Name)
+	}
+
+	for _, serverType := range serverTypes {
+		if slices.Contains(validNames, serverType) {
+			continue
+		}
+
+		if match := provision.ClosestMatch(serverType, validNames); match != "" {
+			return fmt.Errorf("invalid hetzner server type %q, did you mean %s?", serverType, match)
+		}
+		return fmt.Errorf("invalid hetzner server type %q, valid server types: %s", serverType, strings.Join(validNames, ", "))
+	}
+
+	return nil
+}
+
+// validateDatacenter checks that datacenter exists, lies in region if that is set,
+// and currently has one of serverTypes available.
+func (p *HetznerProvisioner) validateDatacenter(ctx context.Context, datacenter, region string, serverTypes []string) error {
+	dc, _, err := p.client.Datacenter.GetByName(ctx, datacenter)
+	if err != nil {
+		return err
+	}
+
+	if dc == nil {
+		return fmt.Errorf("invalid hetzner datacenter %q", datacenter)
+	}
+
+	if region != "" && dc.Location != nil && dc.Location.Name != region {
+		return fmt.Errorf("datacenter %s is in location %s, not %s", datacenter, dc.Location.Name, region)
+	}
+
+	for _, serverType := range serverTypes {
+		t, _, err := p.client.ServerType.GetByName(ctx, serverType)
+		if err != nil {
+			return err
+		}
+
+		if t == nil {
+			return fmt.Errorf("server type %s not found", serverType)
+		}
+
+		// the datacenter only references the server types by id
+		for _, available := range dc.ServerTypes.Available {
+			if available.ID == t.ID {
+				return nil
+			}
+		}
+
+		log.Warn("Server type not available in datacenter", "serverType", serverType, "datacenter", datacenter)
+	}
+
+	return fmt.Errorf("none of the server types %s is available in datacenter %s", strings.Join(serverTypes, ", "), datacenter)
+}
+
+func (p *HetznerProvisioner) existingSshKey(ctx context.Context) (*hcloud.SSHKey, error) {
+	if p.SshPrivateKeyFile == "" {
+		return nil, errors.New("an ssh private key file is required when reusing an ssh key")
+	}
+
+	sshKey, _, err := p.client.SSHKey.GetByName(ctx, p.SshKeyName)
+	if err != nil {
+		return nil, err
+	}
+
+	if sshKey == nil {
+		return nil, fmt.Errorf("ssh key %s not found", p.SshKeyName)
+	}
+
+	return sshKey, nil
+}
+
+func (p *HetznerProvisioner) createSshKey(ctx context.Context, name string, labels map[string]string) (*hcloud.SSHKey, error) {
 	sshKey, _, err := p.client.SSHKey.GetByName(ctx, name)
 	if err != nil {
 		return nil, err
@@ -98,16 +434,22 @@ func (p *HetznerProvisioner) createSshKey(ctx context.Context, name string) (*hc
 	sshKey, _, err = p.client.SSHKey.Create(ctx, hcloud.SSHKeyCreateOpts{
 		Name:      name,
 		PublicKey: p.pubKeyPem,
+		Labels:    labels,
 	})
 	return sshKey, err
 }
 
-func (p *HetznerProvisioner) createOrUpdateFirewall(ctx context.Context, name string, wgPort uint16) (*hcloud.Firewall, error) {
+func (p *HetznerProvisioner) createOrUpdateFirewall(ctx context.Context, name string, wgPorts provision.PortRange, openPorts []provision.PortRule, labels map[string]string) (*hcloud.Firewall, error) {
 	_, netAny, err := net.ParseCIDR("0.0.0.0/0")
 	if err != nil {
 		return nil, err
 	}
 
+	_, netAny6, err := net.ParseCIDR("::/0")
+	if err != nil {
+		return nil, err
+	}
+
 	firewall, _, err := p.client.Firewall.GetByName(ctx, name)
 	if err != nil {
 		return nil, err
@@ -116,8 +458,8 @@ func (p *HetznerProvisioner) createOrUpdateFirewall(ctx context.Context, name st
 	var rules = []hcloud.FirewallRule{
 		{
 			Direction:   hcloud.FirewallRuleDirectionIn,
-			SourceIPs:   []net.IPNet{*netAny},
-			Port:        pstr(strconv.FormatUint(uint64(wgPort), 10)),
+			SourceIPs:   []net.IPNet{*netAny, *netAny6},
+			Port:        pstr(wgPorts.String()),
 			Protocol:    hcloud.FirewallRuleProtocolUDP,
 			Description: pstr("Wireguard"),
 		},
@@ -130,153 +472,805 @@ func (p *HetznerProvisioner) createOrUpdateFirewall(ctx context.Context, name st
 		},
 	}
 
+	for _, openPort := range openPorts {
+		protocol := hcloud.FirewallRuleProtocolTCP
+		if openPort.Protocol == "udp" {
+			protocol = hcloud.FirewallRuleProtocolUDP
+		}
+
+		rules = append(rules, hcloud.FirewallRule{
+			Direction:   hcloud.FirewallRuleDirectionIn,
+			SourceIPs:   []net.IPNet{openPort.Cidr},
+			Port:        pstr(strconv.FormatUint(uint64(openPort.Port), 10)),
+			Protocol:    protocol,
+			Description: pstr("wg-ondemand " + openPort.String()),
+		})
+	}
+
 	if firewall != nil {
-		firewall.Rules = rules
-		newFw, _, err := p.client.Firewall.Update(ctx, firewall, hcloud.FirewallUpdateOpts{})
-		return newFw, err
+		// update only changes name and labels, the rules have to be replaced separately
+		newFw, _, err := p.client.Firewall.Update(ctx, firewall, hcloud.FirewallUpdateOpts{
+			Labels: labels,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		actions, _, err := p.client.Firewall.SetRules(ctx, newFw, hcloud.FirewallSetRulesOpts{
+			Rules: rules,
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = p.client.Action.WaitFor(ctx, actions...)
+		if err != nil {
+			return nil, err
+		}
+
+		newFw.Rules = rules
+		return newFw, nil
 	}
 
 	firewallResult, _, err := p.client.Firewall.Create(ctx, hcloud.FirewallCreateOpts{
-		Name:  name,
-		Rules: rules,
+		Name:   name,
+		Rules:  rules,
+		Labels: labels,
 	})
 
 	return firewallResult.Firewall, err
 }
 
-func (p *HetznerProvisioner) createOrRecreateServer(ctx context.Context, id string, region string, sshKey *hcloud.SSHKey, firewall hcloud.Firewall) (*hcloud.Server, error) {
+// createOrRecreateServer creates the server in datacenter if set, in the location region otherwise,
+// and attaches a volume of volumeSize GB unless it is 0.
+func (p *HetznerProvisioner) createOrRecreateServer(ctx context.Context, id string, region string, datacenter string, serverType string, sshKey *hcloud.SSHKey, firewall hcloud.Firewall, userData string, enableIPv6 bool, volumeSize int, labels map[string]string) (*hcloud.Server, error) {
 	server, _, err := p.client.Server.GetByName(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
 	if server != nil {
-		_, _, err = p.client.Server.DeleteWithResult(ctx, server)
+		result, _, err := p.client.Server.DeleteWithResult(ctx, server)
+		if err != nil {
+			return nil, err
+		}
+
+		// a volume can only be attached to the new server once the old one is gone
+		err = p.client.Action.WaitFor(ctx, result.Action)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	serverResp, _, err := p.client.Server.Create(ctx, hcloud.ServerCreateOpts{
+	opts := hcloud.ServerCreateOpts{
 		Name:  id,
 		Image: &hcloud.Image{Name: "rocky-9"},
 		PublicNet: &hcloud.ServerCreatePublicNet{
 			EnableIPv4: true,
+			EnableIPv6: enableIPv6,
 		},
 		SSHKeys: []*hcloud.SSHKey{
 			sshKey,
 		},
 		Location: &hcloud.Location{Name: region},
 		ServerType: &hcloud.ServerType{
-			Name: "cx22",
+			Name: serverType,
 		},
 		Firewalls: []*hcloud.ServerCreateFirewall{
 			{
 				Firewall: firewall,
 			},
 		},
-	})
+		UserData: userData,
+		Labels:   labels,
+	}
+	if datacenter != "" {
+		opts.Location = nil
+		opts.Datacenter = &hcloud.Datacenter{Name: datacenter}
+	}
+
+	serverResp, _, err := p.client.Server.Create(ctx, opts)
+	if err != nil || volumeSize == 0 {
+		return serverResp.Server, err
+	}
+
+	err = p.attachVolume(ctx, id, serverResp.Server, volumeSize, labels)
+	if err != nil {
+		// the caller only cleans up servers it got back, so do not leave this one behind
+		log.Warn("Deleting server after the volume failed", "server", id)
+		_, _, deleteErr := p.client.Server.DeleteWithResult(context.WithoutCancel(ctx), serverResp.Server)
+		return nil, errors.Join(fmt.Errorf("attach volume: %w", err), deleteErr)
+	}
 
-	return serverResp.Server, err
+	return serverResp.Server, nil
 }
 
-func (p *HetznerProvisioner) runShell(ctx context.Context, server *hcloud.Server, script string) ([]byte, error) {
-	signer, err := ssh.NewSignerFromKey(&p.privKey)
+// attachVolume attaches the volume of the deployment to server, creating it with size GB
+// if it does not exist. An existing volume keeps its data and size across redeploys.
+func (p *HetznerProvisioner) attachVolume(ctx context.Context, id string, server *hcloud.Server, size int, labels map[string]string) error {
+	volume, _, err := p.client.Volume.GetByName(ctx, id)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	if volume == nil {
+		log.Info("Creating volume", "volume", id, "size", size)
+		// creating the volume with a server places it in the location of the server and attaches it
+		result, _, err := p.client.Volume.Create(ctx, hcloud.VolumeCreateOpts{
+			Name:   id,
+			Size:   size,
+			Server: server,
+			Labels: labels,
+		})
+		if err != nil {
+			return err
+		}
+
+		return p.client.Action.WaitFor(ctx, append([]*hcloud.Action{result.Action}, result.NextActions...)...)
+	}
+
+	// volumes can only be attached to servers in their own location
+	if server.Datacenter != nil && server.Datacenter.Location != nil && volume.Location != nil && volume.Location.Name != server.Datacenter.Location.Name {
+		return fmt.Errorf("volume %s is in location %s, not in %s of the server, deploy to %s or remove the volume with delete first", id, volume.Location.Name, server.Datacenter.Location.Name, volume.Location.Name)
+	}
+
+	if volume.Size != size {
+		log.Warn("Keeping the size of the existing volume", "volume", id, "size", volume.Size)
+	}
+
+	log.Info("Attaching existing volume", "volume", id)
+	action, _, err := p.client.Volume.Attach(ctx, volume, server)
+	if err != nil {
+		return err
+	}
+
+	return p.client.Action.WaitFor(ctx, action)
+}
+
+// dialSsh connects to the server at addr, through SshBastion if set.
+func (p *HetznerProvisioner) dialSsh(ctx context.Context, addr string) (*ssh.Client, error) {
+	timeout := p.SshTimeout
+	if timeout <= 0 {
+		timeout = defaultSshTimeout
 	}
 
-	sshClient, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", server.PublicNet.IPv4.IP.String(), sshPort), &ssh.ClientConfig{
-		User: "root",
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	config := &ssh.ClientConfig{
+		Timeout: timeout,
+		User:    p.sshUser(),
 		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
+			ssh.PublicKeys(p.signer),
 		},
+		// the server was just created, its host key is not known yet
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	})
+	}
+
+	if p.SshBastion == "" {
+		conn, err := provision.DialContext(ctx, "tcp", addr, p.Proxy)
+		if err != nil {
+			return nil, err
+		}
+
+		return newSshClient(conn, addr, config)
+	}
+
+	bastion, err := p.dialBastion(ctx, timeout)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("bastion %s: %w", p.SshBastion, err)
 	}
-	defer sshClient.Close()
 
-	session, err := sshClient.NewSession()
+	conn, err := bastion.Dial("tcp", addr)
 	if err != nil {
+		bastion.Close()
 		return nil, err
 	}
-	defer session.Close()
 
-	stdoutBuffer := new(bytes.Buffer)
-	session.Stdout = stdoutBuffer
-	stderrBuffer := new(bytes.Buffer)
-	session.Stderr = stderrBuffer
-
-	err = session.Start(script)
+	client, err := newSshClient(conn, addr, config)
 	if err != nil {
-		log.Error("failed to start session", "err", err, "stderr", stderrBuffer.String())
+		bastion.Close()
 		return nil, err
 	}
 
-	doneChan := make(chan error)
-
 	go func() {
-		doneChan <- session.Wait()
+		client.Wait()
+		bastion.Close()
 	}()
 
-	select {
-	case <-ctx.Done():
-		err = ctx.Err()
-	case err = <-doneChan:
+	return client, nil
+}
+
+// dialBastion connects to SshBastion (user@host[:port]), authenticating with the ssh
+// agent and the server key. The bastion host key has to be in ~/.ssh/known_hosts.
+func (p *HetznerProvisioner) dialBastion(ctx context.Context, timeout time.Duration) (*ssh.Client, error) {
+	user, host, found := strings.Cut(p.SshBastion, "@")
+	if !found || user == "" || host == "" {
+		return nil, errors.New("expected user@host[:port]")
+	}
+
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, strconv.Itoa(sshPort))
 	}
+
+	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		log.Error("failed to wait for session", "err", err, "stderr", stderrBuffer.String())
 		return nil, err
 	}
 
-	return stdoutBuffer.Bytes(), nil
-}
-
-func (p *HetznerProvisioner) DeProvision(ctx context.Context, id string, args provision.DeProvisionArguments) error {
-	err := p.init()
+	hostKeyCallback, err := knownhosts.New(filepath.Join(homeDir, ".ssh", "known_hosts"))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	server, _, err := p.client.Server.GetByName(ctx, id)
-	if err == nil && server != nil {
-		_, _, err = p.client.Server.DeleteWithResult(ctx, server)
+	auth := []ssh.AuthMethod{
+		ssh.PublicKeys(p.signer),
+	}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		agentConn, err := net.Dial("unix", socket)
 		if err != nil {
-			return err
+			log.Warn("Failed to connect to ssh agent", "err", err)
+		} else {
+			defer agentConn.Close()
+			agentSigners, err := agent.NewClient(agentConn).Signers()
+			if err != nil {
+				log.Warn("Failed to list ssh agent keys", "err", err)
+			} else {
+				auth = append([]ssh.AuthMethod{ssh.PublicKeys(agentSigners...)}, auth...)
+			}
 		}
+	}
 
+	conn, err := provision.DialContext(ctx, "tcp", host, p.Proxy)
+	if err != nil {
+		return nil, err
 	}
 
-	sshKey, _, err := p.client.SSHKey.GetByName(ctx, id)
-	if err == nil && sshKey != nil {
-		_, err = p.client.SSHKey.Delete(ctx, sshKey)
+	return newSshClient(conn, host, &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         timeout,
+	})
+}
+
+// newSshClient runs the ssh handshake on conn, bounded by config.Timeout since the
+// connection is not dialed by the ssh package.
+func newSshClient(conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if config.Timeout > 0 {
+		err := conn.SetDeadline(time.Now().Add(config.Timeout))
 		if err != nil {
-			return err
+			conn.Close()
+			return nil, err
 		}
 	}
-	return nil
-}
 
-func (p *HetznerProvisioner) Locations(ctx context.Context) ([]provision.Location, error) {
-	err := p.init()
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	hetznerLocations, err := p.client.Location.All(ctx)
+	// the deadline must not cut off long running commands
+	err = conn.SetDeadline(time.Time{})
 	if err != nil {
+		sshConn.Close()
 		return nil, err
 	}
 
-	var locations []provision.Location
-	for _, loc := range hetznerLocations {
-		locations = append(locations, provision.Location{
-			Latitude:  loc.Latitude,
-			Longitude: loc.Longitude,
-			Country:   loc.Country,
-			City:      loc.City,
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+func (p *HetznerProvisioner) runShell(ctx context.Context, server *hcloud.Server, script string) ([]byte, error) {
+	addr := net.JoinHostPort(server.PublicNet.IPv4.IP.String(), strconv.Itoa(sshPort))
+	sshClient, err := p.dialSsh(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer sshClient.Close()
+
+	session, err := sshClient.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	stdoutBuffer := new(bytes.Buffer)
+	session.Stdout = stdoutBuffer
+	stderrBuffer := new(bytes.Buffer)
+	session.Stderr = stderrBuffer
+
+	if p.sshUser() == "root" {
+		err = session.Start(script)
+	} else {
+		// the scripts need root, sudo reads them from stdin so they need no quoting
+		session.Stdin = strings.NewReader(script)
+		err = session.Start("sudo -n bash -s")
+	}
+	if err != nil {
+		log.Error("failed to start session", "err", err, "stderr", stderrBuffer.String())
+		return nil, err
+	}
+
+	doneChan := make(chan error)
+
+	go func() {
+		doneChan <- session.Wait()
+	}()
+
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case err = <-doneChan:
+	}
+	if err != nil {
+		log.Error("failed to wait for session", "err", err, "stderr", stderrBuffer.String())
+		// stdout may still carry the init script output with the failed step
+		return stdoutBuffer.Bytes(), provision.WithOutput(err, stderrBuffer.String())
+	}
+
+	return stdoutBuffer.Bytes(), nil
+}
+
+func (p *HetznerProvisioner) DeProvision(ctx context.Context, id string, args provision.DeProvisionArguments) (err error) {
+	defer func() {
+		metrics.ObserveOperation("hetzner", "deprovision", err)
+	}()
+
+	err = p.init(ctx)
+	if err != nil {
+		return err
+	}
+
+	// attempt every deletion so a failure does not orphan the remaining resources,
+	// the order matters as the firewall can only be deleted once the server is gone
+	var errs []error
+
+	err = p.deleteServer(ctx, id)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("delete server: %w", err))
+	}
+
+	err = p.deleteFirewall(ctx, id)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("delete firewall: %w", err))
+	}
+
+	// the volume was detached by deleting the server
+	err = p.deleteVolume(ctx, id)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("delete volume: %w", err))
+	}
+
+	err = p.deleteSshKey(ctx, id)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("delete ssh key: %w", err))
+	}
+
+	err = p.removePrivateKey(id)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("remove private key: %w", err))
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	log.Info("Done", "id", id)
+	return nil
+}
+
+func (p *HetznerProvisioner) Stop(ctx context.Context, id string, args provision.InstanceArguments) error {
+	err := p.init(ctx)
+	if err != nil {
+		return err
+	}
+
+	server, err := p.getServer(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Powering off server", "server", server.Name)
+	action, _, err := p.client.Server.Poweroff(ctx, server)
+	if err != nil {
+		return err
+	}
+
+	return p.client.Action.WaitFor(ctx, action)
+}
+
+func (p *HetznerProvisioner) Start(ctx context.Context, id string, args provision.InstanceArguments) error {
+	err := p.init(ctx)
+	if err != nil {
+		return err
+	}
+
+	server, err := p.getServer(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Powering on server", "server", server.Name)
+	action, _, err := p.client.Server.Poweron(ctx, server)
+	if err != nil {
+		return err
+	}
+
+	return p.client.Action.WaitFor(ctx, action)
+}
+
+func (p *HetznerProvisioner) Usage(ctx context.Context, id string, args provision.InstanceArguments) (provision.UsageReport, error) {
+	err := p.init(ctx)
+	if err != nil {
+		return provision.UsageReport{}, err
+	}
+
+	server, err := p.getServer(ctx, id)
+	if err != nil {
+		return provision.UsageReport{}, err
+	}
+
+	err = p.loadPrivateKey(id)
+	if err != nil {
+		return provision.UsageReport{}, err
+	}
+
+	command, err := provision.WgTransferCommand(args.InterfaceName)
+	if err != nil {
+		return provision.UsageReport{}, err
+	}
+
+	stdout, err := p.runShell(ctx, server, command)
+	if err != nil {
+		return provision.UsageReport{}, err
+	}
+
+	peers, err := provision.ParseWgTransfer(string(stdout))
+	if err != nil {
+		return provision.UsageReport{}, err
+	}
+
+	return provision.UsageReport{
+		Peers:                 peers,
+		ProviderIngoingBytes:  &server.IngoingTraffic,
+		ProviderOutgoingBytes: &server.OutgoingTraffic,
+	}, nil
+}
+
+func (p *HetznerProvisioner) AddPeer(ctx context.Context, id string, peer provision.Peer, args provision.InstanceArguments) error {
+	command, err := provision.AddPeerCommand(args.InterfaceName, peer)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Adding peer", "publicKey", peer.PublicKey, "ip", peer.WgIp)
+	return p.runPeerCommand(ctx, id, command)
+}
+
+func (p *HetznerProvisioner) RemovePeer(ctx context.Context, id string, publicKey string, args provision.InstanceArguments) error {
+	command, err := provision.RemovePeerCommand(args.InterfaceName, publicKey)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Removing peer", "publicKey", publicKey)
+	return p.runPeerCommand(ctx, id, command)
+}
+
+func (p *HetznerProvisioner) runPeerCommand(ctx context.Context, id string, command string) error {
+	err := p.init(ctx)
+	if err != nil {
+		return err
+	}
+
+	server, err := p.getServer(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	err = p.loadPrivateKey(id)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.runShell(ctx, server, command)
+	return err
+}
+
+func (p *HetznerProvisioner) deleteServer(ctx context.Context, id string) error {
+	server, _, err := p.client.Server.GetByName(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if server == nil {
+		return nil
+	}
+
+	log.Info("Deleting server", "server", id)
+	result, _, err := p.client.Server.DeleteWithResult(ctx, server)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return p.client.Action.WaitFor(ctx, result.Action)
+}
+
+func (p *HetznerProvisioner) deleteVolume(ctx context.Context, id string) error {
+	volume, _, err := p.client.Volume.GetByName(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if volume == nil {
+		return nil
+	}
+
+	log.Info("Deleting volume", "volume", id)
+	_, err = p.client.Volume.Delete(ctx, volume)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (p *HetznerProvisioner) deleteSshKey(ctx context.Context, id string) error {
+	sshKey, _, err := p.client.SSHKey.GetByName(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if sshKey == nil {
+		return nil
+	}
+
+	log.Info("Deleting ssh key", "sshKey", id)
+	_, err = p.client.SSHKey.Delete(ctx, sshKey)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// isNotFound reports whether err says the resource is already gone. Deletions treat
+// that as success, so DeProvision can be run again after it failed half way.
+func isNotFound(err error) bool {
+	return hcloud.IsError(err, hcloud.ErrorCodeNotFound)
+}
+
+func (p *HetznerProvisioner) deleteFirewall(ctx context.Context, id string) error {
+	firewall, _, err := p.client.Firewall.GetByName(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if firewall == nil {
+		return nil
+	}
+
+	log.Info("Deleting firewall", "firewall", id)
+	// the firewall stays applied for a moment after the server deletion finished
+	for attempt := 1; ; attempt++ {
+		_, err = p.client.Firewall.Delete(ctx, firewall)
+		if isNotFound(err) {
+			return nil
+		}
+		if err == nil || !hcloud.IsError(err, hcloud.ErrorCodeResourceInUse) || attempt == firewallDeleteAttempts {
+			return err
+		}
+
+		log.Debug("Firewall still in use, retrying", "firewall", id, "attempt", attempt)
+		if err := sleepContext(ctx, firewallDeleteRetryDelay); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *HetznerProvisioner) Diagnose(ctx context.Context, args provision.InstanceArguments) []provision.CheckResult {
+	err := p.init(ctx)
+	if err != nil {
+		return []provision.CheckResult{{Name: "credentials", Err: err}}
+	}
+
+	var results []provision.CheckResult
+
+	_, err = p.client.Location.All(ctx)
+	results = append(results, provision.CheckResult{Name: "token valid", Err: err})
+	if err != nil {
+		return results
+	}
+
+	if args.Region == "" {
+		results = append(results, provision.CheckResult{Name: "region", Skipped: "not set"})
+	} else {
+		results = append(results, provision.CheckResult{Name: "region", Err: p.validateLocation(ctx, args.Region)})
+	}
+
+	// read-only tokens can list but not create resources, so probe with a throwaway ssh key
+	const probeName = "wg-ondemand-doctor"
+	sshKey, _, err := p.client.SSHKey.Create(ctx, hcloud.SSHKeyCreateOpts{
+		Name:      probeName,
+		PublicKey: p.pubKeyPem,
+	})
+	if err == nil {
+		_, err = p.client.SSHKey.Delete(ctx, sshKey)
+	}
+	results = append(results, provision.CheckResult{Name: "write access", Err: err})
+
+	return results
+}
+
+func (p *HetznerProvisioner) Status(ctx context.Context, id string, args provision.InstanceArguments) (provision.StatusReport, error) {
+	err := p.init(ctx)
+	if err != nil {
+		return provision.StatusReport{}, err
+	}
+
+	server, _, err := p.client.Server.GetByName(ctx, id)
+	if err != nil {
+		return provision.StatusReport{}, err
+	}
+
+	if server == nil {
+		return provision.StatusReport{}, nil
+	}
+
+	report := provision.StatusReport{
+		Exists:   true,
+		Running:  server.Status == hcloud.ServerStatusRunning,
+		ServerIP: server.PublicNet.IPv4.IP,
+	}
+
+	if !report.Running {
+		return report, nil
+	}
+
+	err = p.loadPrivateKey(id)
+	if err != nil {
+		return report, err
+	}
+
+	output, err := provision.ReadInitScriptOutput(func(script string) (string, error) {
+		stdout, err := p.runShell(ctx, server, script)
+		return string(stdout), err
+	})
+	if err != nil {
+		// ssh is not reachable until the server has booted
+		log.Debug("Failed to read init script output", "err", err)
+		return report, nil
+	}
+
+	if output != nil {
+		report.Ready = true
+		report.ServerPublicKey = output.ServerWgPublicKey
+	}
+
+	return report, nil
+}
+
+// Logs reads the cloud-init log and the init script output over ssh. Hetzner only
+// offers the server console via vnc, so there are no logs without a reachable server.
+func (p *HetznerProvisioner) Logs(ctx context.Context, id string, args provision.InstanceArguments) ([]provision.LogSection, error) {
+	err := p.init(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := p.getServer(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.loadPrivateKey(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var sections []provision.LogSection
+	for _, file := range []string{"/var/log/cloud-init-output.log", provision.InitScriptOutputFile} {
+		stdout, err := p.runShell(ctx, server, "tail -n 200 "+file)
+		if err != nil {
+			log.Warn("Failed to read log file", "file", file, "err", err)
+			continue
+		}
+
+		sections = append(sections, provision.LogSection{
+			Title:   file,
+			Content: string(stdout),
+		})
+	}
+
+	return sections, nil
+}
+
+// Bootstrap does nothing, hetzner needs no per project setup.
+func (p *HetznerProvisioner) Bootstrap(ctx context.Context, args provision.InstanceArguments) error {
+	log.Info("Nothing to bootstrap for hetzner")
+	return nil
+}
+
+func (p *HetznerProvisioner) EstimateCost(ctx context.Context, args provision.ProvisionArguments) (provision.CostEstimate, error) {
+	err := p.init(ctx)
+	if err != nil {
+		return provision.CostEstimate{}, err
+	}
+
+	serverType := serverTypeOrDefault(args.InstanceType)
+	estimate := provision.CostEstimate{InstanceType: serverType}
+
+	t, _, err := p.client.ServerType.GetByName(ctx, serverType)
+	if err != nil {
+		return estimate, err
+	}
+
+	if t == nil {
+		return estimate, fmt.Errorf("server type %s not found", serverType)
+	}
+
+	for _, pricing := range t.Pricings {
+		if pricing.Location != nil && pricing.Location.Name == args.Region {
+			estimate.HourlyCost = fmt.Sprintf("%s %s/h", pricing.Hourly.Gross, pricing.Hourly.Currency)
+		}
+	}
+
+	return estimate, nil
+}
+
+// serverTypes returns the server types to try in order, the preferred one first.
+func serverTypes(args provision.ProvisionArguments) []string {
+	return append([]string{serverTypeOrDefault(args.InstanceType)}, args.InstanceTypeFallbacks...)
+}
+
+func serverTypeOrDefault(serverType string) string {
+	if serverType == "" {
+		return defaultServerType
+	}
+	return serverType
+}
+
+// getServer returns the server named id, or an error if it does not exist.
+func (p *HetznerProvisioner) getServer(ctx context.Context, id string) (*hcloud.Server, error) {
+	server, _, err := p.client.Server.GetByName(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if server == nil {
+		return nil, fmt.Errorf("server %s not found", id)
+	}
+
+	return server, nil
+}
+
+func (p *HetznerProvisioner) Name() string {
+	return "hetzner"
+}
+
+func (p *HetznerProvisioner) Locations(ctx context.Context) ([]provision.Location, error) {
+	return provision.SharedLocationCache.Get(ctx, p.Name(), p.fetchLocations)
+}
+
+func (p *HetznerProvisioner) fetchLocations(ctx context.Context) ([]provision.Location, error) {
+	err := p.init(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	hetznerLocations, err := p.client.Location.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var locations []provision.Location
+	for _, loc := range hetznerLocations {
+		locations = append(locations, provision.Location{
+			Latitude:  loc.Latitude,
+			Longitude: loc.Longitude,
+			Country:   loc.Country,
+			City:      loc.City,
 			Key:       loc.Name,
 		})
 	}
@@ -284,16 +1278,177 @@ func (p *HetznerProvisioner) Locations(ctx context.Context) ([]provision.Locatio
 	return locations, nil
 }
 
+// privateKeyFile is where the ssh key of a deployment is kept, so later commands
+// can connect to the server again.
+func privateKeyFile(id string) (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(configDir, "wg-ondemand", "hetzner-"+id+".key"), nil
+}
+
+func (p *HetznerProvisioner) savePrivateKey(id string) error {
+	path, err := privateKeyFile(id)
+	if err != nil {
+		return err
+	}
+
+	block, err := ssh.MarshalPrivateKey(p.privKey, id)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, pem.EncodeToMemory(block), 0600)
+}
+
+// loadPrivateKey loads the ssh key saved when id was provisioned. It is a no-op
+// if SshPrivateKeyFile is set, init already loaded that one.
+func (p *HetznerProvisioner) loadPrivateKey(id string) error {
+	if p.SshPrivateKeyFile != "" {
+		return nil
+	}
+
+	path, err := privateKeyFile(id)
+	if err != nil {
+		return err
+	}
+
+	keyBytes, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read ssh key of %s: %w", id, err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		return err
+	}
+
+	p.signer = signer
+	return nil
+}
+
+func (p *HetznerProvisioner) removePrivateKey(id string) error {
+	path, err := privateKeyFile(id)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// sleepContext waits for the given duration or until the context is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
 func pstr(s string) *string {
 	return &s
 }
 
-func (p *HetznerProvisioner) init() error {
-	token := os.Getenv("HCLOUD_TOKEN")
-	if token == "" {
-		return fmt.Errorf("HCLOUD_TOKEN not set")
+// checkToken probes the token with the smallest possible api call, so an invalid token
+// fails with a hint instead of an api error in the middle of an operation. Once it
+// passed it is not probed again.
+func (p *HetznerProvisioner) checkToken(ctx context.Context) error {
+	if p.tokenChecked {
+		return nil
+	}
+
+	_, _, err := p.client.Location.List(ctx, hcloud.LocationListOpts{
+		ListOpts: hcloud.ListOpts{PerPage: 1},
+	})
+	switch {
+	case err == nil:
+		p.tokenChecked = true
+		return nil
+	case hcloud.IsError(err, hcloud.ErrorCodeUnauthorized):
+		return fmt.Errorf("invalid hetzner token, it may have been deleted; create a read & write token in the cloud console under Security > API tokens and set HCLOUD_TOKEN: %w", err)
+	case hcloud.IsError(err, hcloud.ErrorCodeForbidden):
+		return fmt.Errorf("hetzner token lacks permissions, use a read & write token of the project: %w", err)
+	default:
+		return fmt.Errorf("checking hetzner token: %w", err)
+	}
+}
+
+// sshUser returns SshUser or defaultSshUser if it is empty.
+func (p *HetznerProvisioner) sshUser() string {
+	if p.SshUser == "" {
+		return defaultSshUser
+	}
+	return p.SshUser
+}
+
+func (p *HetznerProvisioner) init(ctx context.Context) error {
+	if !sshUserRegex.MatchString(p.sshUser()) {
+		return fmt.Errorf("invalid ssh user %q", p.SshUser)
+	}
+
+	credentials := p.Credentials
+	if credentials == nil {
+		credentials = EnvTokenProvider{}
+	}
+
+	token, err := credentials.Token()
+	if err != nil {
+		return err
+	}
+	proxy, err := provision.HttpProxy(p.Proxy)
+	if err != nil {
+		return err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+
+	var roundTripper http.RoundTripper = transport
+	if p.MaxRps > 0 {
+		roundTripper = &provision.RateLimitedTransport{
+			Limiter:   provision.NewRateLimiter(p.MaxRps),
+			Transport: transport,
+		}
+	}
+
+	rateLimitMaxWait := p.RateLimitMaxWait
+	if rateLimitMaxWait == 0 {
+		rateLimitMaxWait = defaultRateLimitMaxWait
+	}
+	if rateLimitMaxWait > 0 {
+		roundTripper = &rateLimitRetryTransport{
+			Transport: roundTripper,
+			MaxWait:   rateLimitMaxWait,
+		}
+	}
+
+	p.client = hcloud.NewClient(
+		hcloud.WithToken(token),
+		hcloud.WithHTTPClient(&http.Client{
+			Transport: roundTripper,
+		}),
+	)
+
+	err = p.checkToken(ctx)
+	if err != nil {
+		return err
 	}
-	p.client = hcloud.NewClient(hcloud.WithToken(token))
 
 	pub, priv, err := ed25519.GenerateKey(nil)
 	if err != nil {
@@ -307,5 +1462,22 @@ func (p *HetznerProvisioner) init() error {
 	p.pubKeyPem = string(ssh.MarshalAuthorizedKey(pubKey))
 	p.privKey = priv
 
+	if p.SshPrivateKeyFile != "" {
+		keyBytes, err := os.ReadFile(p.SshPrivateKeyFile)
+		if err != nil {
+			return err
+		}
+
+		p.signer, err = ssh.ParsePrivateKey(keyBytes)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", p.SshPrivateKeyFile, err)
+		}
+	} else {
+		p.signer, err = ssh.NewSignerFromKey(priv)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
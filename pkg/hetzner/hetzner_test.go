@@ -0,0 +1,76 @@
+package hetzner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// newFirewallServer fakes the hcloud firewall endpoints for a firewall named
+// wg-ondemand. Its deletion answers with deleteStatus and deleteCode for the
+// first failures attempts and succeeds afterwards.
+func newFirewallServer(t *testing.T, failures int, deleteStatus int, deleteCode hcloud.ErrorCode, deletes *int) *HetznerProvisioner {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /firewalls", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"firewalls": [{"id": 1, "name": "wg-ondemand"}], "meta": {"pagination": {"page": 1, "per_page": 50, "last_page": 1, "total_entries": 1}}}`)
+	})
+	mux.HandleFunc("DELETE /firewalls/1", func(w http.ResponseWriter, r *http.Request) {
+		*deletes++
+		if *deletes > failures {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(deleteStatus)
+		fmt.Fprintf(w, `{"error": {"code": %q, "message": "test"}}`, deleteCode)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return &HetznerProvisioner{
+		client: hcloud.NewClient(
+			hcloud.WithEndpoint(server.URL),
+			hcloud.WithToken("token"),
+		),
+	}
+}
+
+func TestDeleteFirewall(t *testing.T) {
+	firewallDeleteRetryDelay = 0
+
+	tests := []struct {
+		name         string
+		failures     int
+		deleteStatus int
+		deleteCode   hcloud.ErrorCode
+		wantDeletes  int
+		wantErr      bool
+	}{
+		{name: "deleted", wantDeletes: 1},
+		{name: "in use then deleted", failures: 3, deleteStatus: http.StatusLocked, deleteCode: hcloud.ErrorCodeResourceInUse, wantDeletes: 4},
+		{name: "in use too long", failures: firewallDeleteAttempts, deleteStatus: http.StatusLocked, deleteCode: hcloud.ErrorCodeResourceInUse, wantDeletes: firewallDeleteAttempts, wantErr: true},
+		{name: "already gone", failures: 1, deleteStatus: http.StatusNotFound, deleteCode: hcloud.ErrorCodeNotFound, wantDeletes: 1},
+		{name: "other error", failures: 1, deleteStatus: http.StatusForbidden, deleteCode: hcloud.ErrorCodeForbidden, wantDeletes: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deletes := 0
+			p := newFirewallServer(t, tt.failures, tt.deleteStatus, tt.deleteCode, &deletes)
+
+			err := p.deleteFirewall(context.Background(), "wg-ondemand")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if deletes != tt.wantDeletes {
+				t.Errorf("got %d deletes, want %d", deletes, tt.wantDeletes)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package hetzner
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	labelNameRegex   = regexp.MustCompile(`^([a-zA-Z0-9]([-_.a-zA-Z0-9]*[a-zA-Z0-9])?)?$`)
+	labelPrefixRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+)
+
+const (
+	maxLabelNameLength   = 63
+	maxLabelPrefixLength = 253
+)
+
+// validateLabels checks labels against the hetzner label constraints, which follow the
+// kubernetes ones: [prefix/]name=value.
+func validateLabels(labels map[string]string) error {
+	var errs []error
+	for k, v := range labels {
+		name := k
+		if prefix, rest, ok := strings.Cut(k, "/"); ok {
+			name = rest
+			if len(prefix) > maxLabelPrefixLength || !labelPrefixRegex.MatchString(prefix) {
+				errs = append(errs, fmt.Errorf("invalid label key %q: prefix must be a dns subdomain", k))
+			}
+		}
+		if name == "" || len(name) > maxLabelNameLength || !labelNameRegex.MatchString(name) {
+			errs = append(errs, fmt.Errorf("invalid label key %q: name must be 1 to %d alphanumeric characters, - _ or . inside", k, maxLabelNameLength))
+		}
+
+		if len(v) > maxLabelNameLength || !labelNameRegex.MatchString(v) {
+			errs = append(errs, fmt.Errorf("invalid value of label %q: must be at most %d alphanumeric characters, - _ or . inside", k, maxLabelNameLength))
+		}
+	}
+
+	return errors.Join(errs...)
+}
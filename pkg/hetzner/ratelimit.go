@@ -0,0 +1,76 @@
+package hetzner
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// defaultRateLimitMaxWait bounds the time spent waiting for rate limit resets per request.
+const defaultRateLimitMaxWait = 2 * time.Minute
+
+// rateLimitRetryTransport retries requests the api rejected with 429 once the rate
+// limit resets, as announced by the RateLimit-Reset header, for at most MaxWait in total.
+type rateLimitRetryTransport struct {
+	Transport http.RoundTripper
+	MaxWait   time.Duration
+}
+
+func (t *rateLimitRetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var waited time.Duration
+	for {
+		resp, err := t.Transport.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			return resp, err
+		}
+
+		wait := rateLimitResetWait(resp.Header, time.Now())
+		if waited+wait > t.MaxWait {
+			log.Debug("Rate limit reset is too far away, giving up", "wait", wait, "waited", waited)
+			return resp, nil
+		}
+
+		// the body has to be sent again, hcloud creates its requests with a rewindable one
+		if req.Body != nil && req.GetBody == nil {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		log.Warn("Hetzner api rate limit exceeded, waiting for the reset", "wait", wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		waited += wait
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("failed to rewind request body: %w", err)
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// rateLimitResetWait returns the time until the unix timestamp of the RateLimit-Reset
+// header, at least a second so a missing or stale header does not cause a busy loop.
+func rateLimitResetWait(header http.Header, now time.Time) time.Duration {
+	wait := time.Second
+
+	reset, err := strconv.ParseInt(header.Get("RateLimit-Reset"), 10, 64)
+	if err == nil {
+		if untilReset := time.Unix(reset, 0).Sub(now); untilReset > wait {
+			wait = untilReset
+		}
+	}
+
+	return wait
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	operationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "wg_ondemand",
+		Name:      "operations_total",
+		Help:      "Number of provision and deprovision operations by provider and result.",
+	}, []string{"provider", "operation", "result"})
+
+	phaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "wg_ondemand",
+		Name:      "phase_duration_seconds",
+		Help:      "Duration of provisioning phases like stack creation and the init script.",
+		Buckets:   []float64{5, 15, 30, 60, 120, 300, 600, 1200},
+	}, []string{"provider", "phase"})
+)
+
+func init() {
+	prometheus.MustRegister(operationsTotal, phaseDuration)
+}
+
+// ObserveOperation counts a finished operation, e.g. provision or deprovision.
+func ObserveOperation(provider, operation string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	operationsTotal.WithLabelValues(provider, operation, result).Inc()
+}
+
+// ObservePhase records the duration of a phase that started at start.
+func ObservePhase(provider, phase string, start time.Time) {
+	phaseDuration.WithLabelValues(provider, phase).Observe(time.Since(start).Seconds())
+}
+
+// Serve exposes the metrics on addr under /metrics. It blocks until the server fails.
+func Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	return http.ListenAndServe(addr, mux)
+}
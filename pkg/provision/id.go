@@ -0,0 +1,41 @@
+package provision
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MaxIdLength is the strictest name limit of all providers: hetzner server names
+// have to be valid hostnames (63 characters), cloudformation allows 128.
+const MaxIdLength = 63
+
+// idRegex matches ids that are valid hostnames and cloudformation stack names.
+var idRegex = regexp.MustCompile(`^[a-zA-Z]([-a-zA-Z0-9]*[a-zA-Z0-9])?$`)
+
+// ValidateId checks that id can name the resources of every provider.
+func ValidateId(id string) error {
+	if len(id) > MaxIdLength || !idRegex.MatchString(id) {
+		return fmt.Errorf("invalid id %q: expected up to %d letters, digits and hyphens, starting with a letter", id, MaxIdLength)
+	}
+	return nil
+}
+
+// UniqueId appends a random suffix to base, truncating base so the result stays
+// within MaxIdLength.
+func UniqueId(base string) (string, error) {
+	b := make([]byte, 3)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	suffix := "-" + hex.EncodeToString(b)
+	if len(base)+len(suffix) > MaxIdLength {
+		base = strings.TrimRight(base[:MaxIdLength-len(suffix)], "-")
+	}
+
+	return base + suffix, nil
+}
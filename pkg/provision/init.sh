@@ -1,8 +1,65 @@
 #!/bin/bash
 
+# the script may run several times on the same server (retries), so every step checks
+# what an earlier run already did instead of applying it again
+
 set -e
 
-# install wireguard
+installSkipped="false"
+wgImplementation=""
+publickey=""
+egressInterface=""
+ipv6Egress="none"
+volumeMountPath=""
+portListening="false"
+
+# writeOutput reports the result, with the step that failed if the script exited early
+writeOutput() {
+    trap - ERR
+    mkdir -p "$(dirname {{ .OutputFile }})"
+
+    # the wireguard config without its private key, escaped as a json string
+    serverConfig=""
+    if [ -f /etc/wireguard/{{ .InterfaceName }}.conf ]; then
+        serverConfig=$(sed -e 's/^PrivateKey = .*/PrivateKey = (redacted)/' -e 's/\\/\\\\/g' -e 's/"/\\"/g' /etc/wireguard/{{ .InterfaceName }}.conf | awk '{ printf "%s\\n", $0 }')
+    fi
+
+    {
+    printf "{{ .OutputSeparator }}"
+
+    cat << _EOF
+{
+    "ServerWgPublicKey": "$publickey",
+    "WgImplementation": "$wgImplementation",
+    "EgressInterface": "$egressInterface",
+    "Ipv6Egress": "$ipv6Egress",
+    "InstallSkipped": $installSkipped,
+    "InterfaceName": "{{ .InterfaceName }}",
+    "VolumeMountPath": "$volumeMountPath",
+    "PortListening": $portListening,
+    "ServerConfig": "$serverConfig",
+    "FailedStep": "$1"
+}
+_EOF
+    } | tee {{ .OutputFile }}
+}
+
+# removeOwnRules deletes the nat rules an earlier run added, identified by their comment
+ruleComment="wg-ondemand-{{ .InterfaceName }}"
+removeOwnRules() {
+    "$1" -t nat -S POSTROUTING | grep -F -- "--comment $ruleComment" | sed 's/^-A /-D /' | while read -r rule; do
+        "$1" -t nat $rule
+    done
+}
+
+step=""
+trap 'writeOutput "$step"' ERR
+
+# install wireguard, unless the image already ships it
+step="install"
+if command -v wg >/dev/null; then
+    installSkipped="true"
+else
 {{ if eq .Type "aws" }}
 amazon-linux-extras install -y epel
 rwfile="/etc/yum.repos.d/wireguard.repo"
@@ -15,56 +72,163 @@ sudo yum install -y wireguard-dkms wireguard-tools
     dnf install -y epel-release
     dnf install wireguard-tools -y
 {{ end }}
+fi
 
+# detect whether the kernel supports wireguard, fall back to wireguard-go otherwise
+step="detect-implementation"
+wgImplementation="kernel"
+ip link del wgprobe0 2>/dev/null || true
+if ip link add wgprobe0 type wireguard 2>/dev/null; then
+    ip link del wgprobe0
+else
+    wgImplementation="userspace"
+    if ! command -v wireguard-go >/dev/null; then
+        dnf install -y wireguard-go || yum install -y wireguard-go
+    fi
+    mkdir -p /etc/systemd/system/wg-quick@.service.d
+    cat <<EOF > /etc/systemd/system/wg-quick@.service.d/userspace.conf
+[Service]
+Environment=WG_QUICK_USERSPACE_IMPLEMENTATION=wireguard-go
+EOF
+    systemctl daemon-reload
+fi
 
+{{ if .VolumeMountPath }}
+# format the data volume once and mount it by its label, it may be attached after boot
+step="volume"
+volumeLabel="wg-ondemand"
+volumeDevice=""
+for attempt in $(seq 1 30); do
+    volumeDevice=$(blkid -L "$volumeLabel" || true)
+    if [ -z "$volumeDevice" ]; then
+        # the new volume is the only disk without partitions and filesystem
+        for disk in $(lsblk -dpno NAME,TYPE | awk '$2 == "disk" { print $1 }'); do
+            if [ "$(lsblk -no NAME "$disk" | wc -l)" = "1" ] && [ -z "$(blkid -o value -s TYPE "$disk" || true)" ]; then
+                mkfs.ext4 -q -L "$volumeLabel" "$disk"
+                volumeDevice="$disk"
+                break
+            fi
+        done
+    fi
+    if [ -n "$volumeDevice" ]; then
+        break
+    fi
+    sleep 2
+done
+if [ -z "$volumeDevice" ]; then
+    echo "data volume not found" >&2
+    false
+fi
 
+mkdir -p {{ .VolumeMountPath }}
+if ! grep -q "^LABEL=$volumeLabel " /etc/fstab; then
+    echo "LABEL=$volumeLabel {{ .VolumeMountPath }} ext4 defaults,nofail 0 2" >> /etc/fstab
+fi
+if ! mountpoint -q {{ .VolumeMountPath }}; then
+    mount {{ .VolumeMountPath }}
+fi
+volumeMountPath="{{ .VolumeMountPath }}"
+{{ end }}
+
+step="ip-forward"
 if ! grep -q "net.ipv4.ip_forward = 1" /etc/sysctl.conf >/dev/null; then
     echo "net.ipv4.ip_forward = 1" >> /etc/sysctl.conf
 fi
 sysctl -p
 
 # generate wireguard keys
+step="keys"
 mkdir -p /etc/wireguard
 cd /etc/wireguard
 
-if ! [ -f privatekey ]; then
-    wg genkey | tee privatekey
+umask 077
+{{ if .ServerPrivateKey }}
+echo "{{ .ServerPrivateKey }}" > privatekey
+cat privatekey | wg pubkey > publickey
+{{ else }}
+# keep the keys of an earlier run, its public key may already have been published
+if ! [ -s privatekey ]; then
+    wg genkey > privatekey
 fi
 
-if ! [ -f publickey ]; then
+if ! [ -s publickey ]; then
     cat privatekey | wg pubkey > publickey
 fi
+{{ end }}
 
 privatekey=$(cat privatekey)
 publickey=$(cat publickey)
 
 # configure wireguard
-cat <<EOF > /etc/wireguard/wg0.conf
+step="wireguard"
+cat <<EOF > /etc/wireguard/{{ .InterfaceName }}.conf
 [Interface]
-Address = {{ .ServerWgIp }}/32
+Address = {{ .ServerWgIp }}/32{{ if .ServerWgIp6 }}, {{ .ServerWgIp6 }}/128{{ end }}
 PrivateKey = $privatekey
 ListenPort = {{ .WgPort }}
+{{ if .Mtu }}MTU = {{ .Mtu }}
+{{ end }}
+{{ .PeerSections }}EOF
+umask 022
 
-[Peer]
-PublicKey = {{ .ClientPublicKey }}
-AllowedIPs = {{ .ClientWgIp }}/32
-EOF
-
-systemctl enable wg-quick@wg0
-systemctl restart wg-quick@wg0
+systemctl enable wg-quick@{{ .InterfaceName }}
+systemctl restart wg-quick@{{ .InterfaceName }}
 
 # configure iptables
+step="nat"
+egressInterface="{{ .EgressInterface }}"
+if [ -z "$egressInterface" ]; then
+    egressInterface=$(ip route get 1.1.1.1 | sed -n 's/.* dev \([^ ]*\).*/\1/p')
+fi
+
 yum install -y iptables-services
 systemctl enable iptables
-iptables -t nat -I POSTROUTING 1 -s {{ .ClientWgIp }}/32 -o eth0 -j MASQUERADE
+removeOwnRules iptables
+for natSource in {{ .NatSources }}; do
+    iptables -t nat -I POSTROUTING 1 -s "$natSource" -o "$egressInterface" -m comment --comment "$ruleComment" -j MASQUERADE
+done
 service iptables save
 
-####################### OUTPUT #######################
+# configure ipv6 egress: route if the client address is inside the server's prefix, nat66 otherwise
+step="ipv6"
+{{ if .ClientWgIp6 }}
+serverIp6=$(ip -6 addr show dev "$egressInterface" scope global | sed -n 's/.*inet6 \([^ ]*\).*/\1/p' | head -n 1)
+if [ -n "$serverIp6" ]; then
+    if ! grep -q "net.ipv6.conf.all.forwarding = 1" /etc/sysctl.conf >/dev/null; then
+        echo "net.ipv6.conf.all.forwarding = 1" >> /etc/sysctl.conf
+    fi
+    sysctl -p
+
+    if [ "${serverIp6#*/}" != "128" ] && python3 -c "import ipaddress,sys; sys.exit(0 if ipaddress.ip_address('{{ .ClientWgIp6 }}') in ipaddress.ip_interface('$serverIp6').network else 1)"; then
+        ipv6Egress="routed"
+        sysctl -w net.ipv6.conf.all.proxy_ndp=1
+        ip -6 neigh add proxy {{ .ClientWgIp6 }} dev "$egressInterface" || true
+    else
+        ipv6Egress="nat66"
+        removeOwnRules ip6tables
+        ip6tables -t nat -I POSTROUTING 1 -s {{ .ClientWgIp6 }}/128 -o "$egressInterface" -m comment --comment "$ruleComment" -j MASQUERADE
+        service ip6tables save || true
+    fi
+fi
+{{ end }}
 
-printf "{{ .OutputSeparator }}"
+# check that wireguard listens on its port and no host firewall drops the packets
+step="port-check"
+if ss -Huln "sport = :{{ .WgPort }}" | grep -q .; then
+    portListening="true"
+fi
+if [ "$portListening" = "true" ] && systemctl is-active -q firewalld; then
+    if ! firewall-cmd -q --query-port={{ .WgPort }}/udp; then
+        portListening="false"
+    fi
+fi
+# only a catch-all drop is detected, without a rule accepting the port
+if [ "$portListening" = "true" ] && iptables -S INPUT | grep -qE '^-P INPUT DROP|^-A INPUT -j (DROP|REJECT)'; then
+    if ! iptables -S INPUT | grep -qE -- "-p udp .*--dport {{ .WgPort }} .*-j ACCEPT"; then
+        portListening="false"
+    fi
+fi
 
-cat << _EOF
-{
-    "ServerWgPublicKey": "$publickey"
-}
-_EOF
+####################### OUTPUT #######################
+
+writeOutput ""
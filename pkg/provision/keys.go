@@ -0,0 +1,65 @@
+package provision
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const wgKeyLength = 32
+
+// ValidatePublicKey checks that key is a base64 encoded wireguard key.
+func ValidatePublicKey(key string) error {
+	return validateKey("public", key)
+}
+
+// ValidatePrivateKey checks that key is a base64 encoded wireguard key. Private and
+// public keys have the same format.
+func ValidatePrivateKey(key string) error {
+	return validateKey("private", key)
+}
+
+func validateKey(kind, key string) error {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return fmt.Errorf("invalid %s key: %w", kind, err)
+	}
+
+	if len(decoded) != wgKeyLength {
+		return fmt.Errorf("invalid %s key: decoded length is %d bytes, expected %d", kind, len(decoded), wgKeyLength)
+	}
+
+	// the decoder skips line breaks, but keys end up in shell scripts and have to be
+	// exactly the canonical encoding
+	if base64.StdEncoding.EncodeToString(decoded) != key {
+		return fmt.Errorf("invalid %s key: not canonically encoded", kind)
+	}
+
+	return nil
+}
+
+// ReadPublicKeyFile reads and validates a wireguard public key as written by wg pubkey.
+func ReadPublicKeyFile(path string) (string, error) {
+	return readKeyFile(path, ValidatePublicKey)
+}
+
+// ReadPrivateKeyFile reads and validates a wireguard private key as written by wg genkey.
+func ReadPrivateKeyFile(path string) (string, error) {
+	return readKeyFile(path, ValidatePrivateKey)
+}
+
+func readKeyFile(path string, validate func(string) error) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	key := strings.TrimSpace(string(content))
+	err = validate(key)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+
+	return key, nil
+}
@@ -0,0 +1,128 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const earthRadiusKm = 6371.0
+
+// ErrUnknownLocation is returned by ResolveLocation if nothing matches the input.
+var ErrUnknownLocation = errors.New("unknown location")
+
+// ResolveLocation finds the location of provisioner that input names by its key, city or
+// country, ignoring case, so frankfurt resolves to eu-central-1 on aws. A matching key
+// wins, several matching cities or countries are ambiguous.
+func ResolveLocation(ctx context.Context, provisioner Provisioner, input string) (Location, error) {
+	locations, err := provisioner.Locations(ctx)
+	if err != nil {
+		return Location{}, err
+	}
+
+	input = strings.TrimSpace(input)
+	for _, loc := range locations {
+		if strings.EqualFold(loc.Key, input) {
+			return loc, nil
+		}
+	}
+
+	var matches []Location
+	for _, loc := range locations {
+		// cities may carry a state, e.g. Ashburn, VA
+		city, _, _ := strings.Cut(loc.City, ",")
+		if strings.EqualFold(loc.City, input) || strings.EqualFold(city, input) || strings.EqualFold(loc.Country, input) {
+			matches = append(matches, loc)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return Location{}, fmt.Errorf("%w %q for %s", ErrUnknownLocation, input, provisioner.Name())
+	case 1:
+		return matches[0], nil
+	}
+
+	var candidates []string
+	for _, loc := range matches {
+		candidates = append(candidates, fmt.Sprintf("%s (%s, %s)", loc.Key, loc.City, loc.Country))
+	}
+	return Location{}, fmt.Errorf("location %q is ambiguous, use one of: %s", input, strings.Join(candidates, ", "))
+}
+
+// LocationDistance is a location together with its distance to a reference point.
+type LocationDistance struct {
+	Location   `yaml:",inline"`
+	DistanceKm float64 `json:"distanceKm" yaml:"distanceKm"`
+}
+
+// ParseCoordinates parses "lat,long".
+func ParseCoordinates(s string) (float64, float64, error) {
+	latStr, longStr, found := strings.Cut(s, ",")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid coordinates %q: expected lat,long", s)
+	}
+
+	lat, err := strconv.ParseFloat(strings.TrimSpace(latStr), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return 0, 0, fmt.Errorf("invalid latitude %q", latStr)
+	}
+
+	long, err := strconv.ParseFloat(strings.TrimSpace(longStr), 64)
+	if err != nil || long < -180 || long > 180 {
+		return 0, 0, fmt.Errorf("invalid longitude %q", longStr)
+	}
+
+	return lat, long, nil
+}
+
+// Distance returns the haversine distance in kilometers between the location and lat/long.
+func (l Location) Distance(lat, long float64) float64 {
+	toRad := func(deg float64) float64 {
+		return deg * math.Pi / 180
+	}
+
+	dLat := toRad(lat - l.Latitude)
+	dLong := toRad(long - l.Longitude)
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(l.Latitude))*math.Cos(toRad(lat))*math.Sin(dLong/2)*math.Sin(dLong/2)
+
+	return 2 * earthRadiusKm * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// SortByDistance returns the locations sorted by distance to lat/long, nearest first.
+// Locations with unknown coordinates are sorted last.
+func SortByDistance(locations []Location, lat, long float64) []LocationDistance {
+	result := make([]LocationDistance, 0, len(locations))
+	for _, loc := range locations {
+		result = append(result, LocationDistance{
+			Location:   loc,
+			DistanceKm: loc.Distance(lat, long),
+		})
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].CoordinatesUnknown != result[j].CoordinatesUnknown {
+			return !result[i].CoordinatesUnknown
+		}
+		return result[i].DistanceKm < result[j].DistanceKm
+	})
+
+	return result
+}
+
+// NearestLocation returns the location nearest to lat/long, ignoring locations with
+// unknown coordinates.
+func NearestLocation(locations []Location, lat, long float64) (Location, bool) {
+	sorted := SortByDistance(locations, lat, long)
+	if len(sorted) == 0 || sorted[0].CoordinatesUnknown {
+		return Location{}, false
+	}
+
+	return sorted[0].Location, true
+}
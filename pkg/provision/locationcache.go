@@ -0,0 +1,87 @@
+package provision
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// SharedLocationCache is the location cache of all providers, keyed by provider name.
+var SharedLocationCache = NewLocationCache(time.Hour)
+
+// LocationCache keeps the locations of a key for ttl. Concurrent Get calls of a key
+// that is not cached share a single fetch.
+type LocationCache struct {
+	ttl time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]locationCacheEntry
+	fetches map[string]*locationFetch
+}
+
+type locationCacheEntry struct {
+	locations []Location
+	fetchedAt time.Time
+}
+
+// locationFetch is a running fetch. locations and err are set before done is closed.
+type locationFetch struct {
+	done      chan struct{}
+	locations []Location
+	err       error
+}
+
+func NewLocationCache(ttl time.Duration) *LocationCache {
+	return &LocationCache{
+		ttl:     ttl,
+		entries: map[string]locationCacheEntry{},
+		fetches: map[string]*locationFetch{},
+	}
+}
+
+// Get returns the cached locations of key, calling fetch if they are missing or older
+// than ttl. Failed fetches are not cached.
+func (c *LocationCache) Get(ctx context.Context, key string, fetch func(ctx context.Context) ([]Location, error)) ([]Location, error) {
+	c.mutex.Lock()
+	if entry, ok := c.entries[key]; ok && time.Since(entry.fetchedAt) < c.ttl {
+		c.mutex.Unlock()
+		return slices.Clone(entry.locations), nil
+	}
+
+	f, ok := c.fetches[key]
+	if !ok {
+		f = &locationFetch{done: make(chan struct{})}
+		c.fetches[key] = f
+		// the fetch is shared, so it must not be cancelled with the ctx of one caller
+		go c.fetch(context.WithoutCancel(ctx), key, f, fetch)
+	}
+	c.mutex.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-f.done:
+		return slices.Clone(f.locations), f.err
+	}
+}
+
+func (c *LocationCache) fetch(ctx context.Context, key string, f *locationFetch, fetch func(ctx context.Context) ([]Location, error)) {
+	f.locations, f.err = fetch(ctx)
+
+	c.mutex.Lock()
+	delete(c.fetches, key)
+	if f.err == nil {
+		c.entries[key] = locationCacheEntry{locations: f.locations, fetchedAt: time.Now()}
+	}
+	c.mutex.Unlock()
+
+	close(f.done)
+}
+
+// Invalidate drops the cached locations of key, the next Get fetches them again.
+func (c *LocationCache) Invalidate(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.entries, key)
+}
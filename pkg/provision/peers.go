@@ -0,0 +1,152 @@
+package provision
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Peer is a wireguard client of the server.
+type Peer struct {
+	PublicKey string
+	WgIp      net.IP
+	// WgIp6 is only used if the tunnel is dual stack.
+	WgIp6 net.IP
+}
+
+// AllowedIPs returns the tunnel addresses of the peer as host routes, so a peer can
+// not send with the address of another one.
+func (p Peer) AllowedIPs() string {
+	allowedIps := p.WgIp.String() + "/32"
+	if p.WgIp6 != nil {
+		allowedIps += ", " + p.WgIp6.String() + "/128"
+	}
+	return allowedIps
+}
+
+// ParsePeer parses publickey,ip.
+func ParsePeer(s string) (Peer, error) {
+	publicKey, ipStr, ok := strings.Cut(s, ",")
+	if !ok {
+		return Peer{}, fmt.Errorf("invalid peer %q: expected publickey,ip", s)
+	}
+
+	err := ValidatePublicKey(publicKey)
+	if err != nil {
+		return Peer{}, fmt.Errorf("invalid peer %q: %w", s, err)
+	}
+
+	ip := net.ParseIP(ipStr)
+	if ip == nil || ip.To4() == nil {
+		return Peer{}, fmt.Errorf("invalid peer %q: invalid ipv4 address %q", s, ipStr)
+	}
+
+	return Peer{PublicKey: publicKey, WgIp: ip}, nil
+}
+
+// AllPeers returns the client of ClientPublicKey followed by the additional Peers.
+func (a ProvisionArguments) AllPeers() []Peer {
+	peers := []Peer{{
+		PublicKey: a.ClientPublicKey,
+		WgIp:      a.ClientWgIp,
+		WgIp6:     a.ClientWgIp6,
+	}}
+
+	return append(peers, a.Peers...)
+}
+
+// validatePeers checks that every peer has its own key and tunnel address.
+func (a ProvisionArguments) validatePeers() error {
+	keys := map[string]bool{}
+	ips := map[string]bool{a.ServerWgIp.String(): true}
+	for _, peer := range a.AllPeers() {
+		// the keys and addresses are written into the init script
+		err := ValidatePublicKey(peer.PublicKey)
+		if err != nil {
+			return fmt.Errorf("peer %q: %w", peer.PublicKey, err)
+		}
+		if peer.WgIp.To4() == nil {
+			return fmt.Errorf("peer %s: invalid ipv4 address %q", peer.PublicKey, peer.WgIp)
+		}
+		if peer.WgIp6 != nil && peer.WgIp6.To4() != nil {
+			return fmt.Errorf("peer %s: invalid ipv6 address %q", peer.PublicKey, peer.WgIp6)
+		}
+
+		if keys[peer.PublicKey] {
+			return fmt.Errorf("duplicate peer public key %s", peer.PublicKey)
+		}
+		keys[peer.PublicKey] = true
+
+		for _, ip := range []net.IP{peer.WgIp, peer.WgIp6} {
+			if ip == nil {
+				continue
+			}
+			if ips[ip.String()] {
+				return fmt.Errorf("tunnel address %s of peer %s is already in use", ip, peer.PublicKey)
+			}
+			ips[ip.String()] = true
+		}
+	}
+
+	return nil
+}
+
+// AddPeerCommand adds peer to the running interface, DefaultInterfaceName if empty,
+// saves the config and nats the traffic of the peer like the init script does, tagging
+// the rule with the comment of the interface.
+func AddPeerCommand(interfaceName string, peer Peer) (string, error) {
+	interfaceName, err := resolveInterfaceName(interfaceName)
+	if err != nil {
+		return "", err
+	}
+
+	err = ValidatePublicKey(peer.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	if peer.WgIp.To4() == nil {
+		return "", fmt.Errorf("invalid peer ip %q", peer.WgIp)
+	}
+
+	return fmt.Sprintf(`set -e
+wg set %[1]s peer %[2]s allowed-ips %[3]s
+wg-quick save %[1]s
+egressInterface=$(sed -n 's/.*"EgressInterface": "\(.*\)".*/\1/p' %[4]s)
+if [ -z "$egressInterface" ]; then
+    egressInterface=$(ip route get 1.1.1.1 | sed -n 's/.* dev \([^ ]*\).*/\1/p')
+fi
+iptables -t nat -C POSTROUTING -s %[5]s/32 -o "$egressInterface" -m comment --comment wg-ondemand-%[1]s -j MASQUERADE 2>/dev/null || iptables -t nat -I POSTROUTING 1 -s %[5]s/32 -o "$egressInterface" -m comment --comment wg-ondemand-%[1]s -j MASQUERADE
+service iptables save
+`, interfaceName, peer.PublicKey, strings.ReplaceAll(peer.AllowedIPs(), " ", ""), InitScriptOutputFile, peer.WgIp), nil
+}
+
+// RemovePeerCommand removes the peer with publicKey from the running interface,
+// DefaultInterfaceName if empty, saves the config and drops the nat rules of its addresses.
+// Only rules tagged with the comment of the interface are removed.
+func RemovePeerCommand(interfaceName, publicKey string) (string, error) {
+	interfaceName, err := resolveInterfaceName(interfaceName)
+	if err != nil {
+		return "", err
+	}
+
+	err = ValidatePublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(`set -e
+allowedIps=$(wg show %[1]s allowed-ips | awk -v key=%[2]s '$1 == key { for (i = 2; i <= NF; i++) print $i }')
+if [ -z "$allowedIps" ] && ! wg show %[1]s peers | grep -qx %[2]s; then
+    echo "peer %[2]s not found" >&2
+    exit 1
+fi
+wg set %[1]s peer %[2]s remove
+wg-quick save %[1]s
+for allowedIp in $allowedIps; do
+    iptables -t nat -S POSTROUTING | grep -F -- "-s $allowedIp " | grep -F -- "--comment wg-ondemand-%[1]s " | grep MASQUERADE | sed 's/^-A /-D /' | while read -r rule; do
+        iptables -t nat $rule
+    done
+done
+service iptables save
+`, interfaceName, publicKey), nil
+}
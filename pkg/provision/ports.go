@@ -0,0 +1,94 @@
+package provision
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type PortRule struct {
+	Protocol string
+	Port     uint16
+	Cidr     net.IPNet
+}
+
+// String formats the rule as proto:port:cidr, the same format ParsePortRule accepts.
+func (r PortRule) String() string {
+	return fmt.Sprintf("%s:%d:%s", r.Protocol, r.Port, r.Cidr.String())
+}
+
+// ParsePortRule parses proto:port[:cidr]. If the cidr is omitted defaultCidr is used.
+func ParsePortRule(s string, defaultCidr net.IPNet) (PortRule, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) < 2 {
+		return PortRule{}, fmt.Errorf("invalid port rule %q: expected proto:port[:cidr]", s)
+	}
+
+	rule := PortRule{
+		Protocol: strings.ToLower(parts[0]),
+		Cidr:     defaultCidr,
+	}
+
+	if rule.Protocol != "tcp" && rule.Protocol != "udp" {
+		return PortRule{}, fmt.Errorf("invalid port rule %q: protocol must be tcp or udp", s)
+	}
+
+	port, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil || port == 0 {
+		return PortRule{}, fmt.Errorf("invalid port rule %q: invalid port %q", s, parts[1])
+	}
+	rule.Port = uint16(port)
+
+	if len(parts) == 3 {
+		_, cidr, err := net.ParseCIDR(parts[2])
+		if err != nil {
+			return PortRule{}, fmt.Errorf("invalid port rule %q: %w", s, err)
+		}
+		rule.Cidr = *cidr
+	}
+
+	return rule, nil
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Start uint16
+	End   uint16
+}
+
+// String formats the range as start-end, the format hetzner firewall rules accept.
+func (r PortRange) String() string {
+	if r.Start == r.End {
+		return strconv.FormatUint(uint64(r.Start), 10)
+	}
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.Start && port <= r.End
+}
+
+// ParsePortRange parses start-end.
+func ParsePortRange(s string) (PortRange, error) {
+	startStr, endStr, found := strings.Cut(s, "-")
+	if !found {
+		return PortRange{}, fmt.Errorf("invalid port range %q: expected start-end", s)
+	}
+
+	start, err := strconv.ParseUint(startStr, 10, 16)
+	if err != nil || start == 0 {
+		return PortRange{}, fmt.Errorf("invalid port range %q: invalid start port", s)
+	}
+
+	end, err := strconv.ParseUint(endStr, 10, 16)
+	if err != nil || end == 0 {
+		return PortRange{}, fmt.Errorf("invalid port range %q: invalid end port", s)
+	}
+
+	if start > end {
+		return PortRange{}, fmt.Errorf("invalid port range %q: start is greater than end", s)
+	}
+
+	return PortRange{Start: uint16(start), End: uint16(end)}, nil
+}
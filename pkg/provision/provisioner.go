@@ -5,10 +5,13 @@ import (
 	_ "embed"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
+	"regexp"
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/charmbracelet/log"
 )
@@ -16,10 +19,39 @@ import (
 //go:embed init.sh
 var initScript string
 
+var interfaceNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
+
+const outputSeparator = "93b5409013b3265be85973fc8434a05e8f2e31bd9dae057501e704d40a8ac39f"
+
+// InitScriptOutputFile is where the init script persists its output so it can be
+// collected after the fact, e.g. when the script was run by cloud-init.
+const InitScriptOutputFile = "/var/lib/wg-ondemand/init-output"
+
+// DefaultInterfaceName is the wireguard interface on the server unless configured otherwise.
+const DefaultInterfaceName = "wg0"
+
+// VolumeMountPath is where the init script mounts the data volume of VolumeSize.
+const VolumeMountPath = "/mnt/wg-ondemand"
+
+const (
+	ProvisionMethodSsh       = "ssh"
+	ProvisionMethodSsm       = "ssm"
+	ProvisionMethodCloudInit = "cloud-init"
+)
+
 type ProvisionResult struct {
 	ServerIP        net.IP
 	ServerWgIp      net.IP
 	ServerPublicKey string
+	// InterfaceName is the wireguard interface on the server.
+	InterfaceName string
+	// InstanceType is the instance or server type actually used, empty if the provider
+	// does not choose it.
+	InstanceType string
+	// VolumeMountPath is where the data volume is mounted, empty without a volume.
+	VolumeMountPath string
+	// ServerConfig is the wireguard config of the server with the private key redacted.
+	ServerConfig string
 }
 
 type ProvisionArguments struct {
@@ -29,58 +61,359 @@ type ProvisionArguments struct {
 	WgPort          uint16
 	Type            string
 	Region          string
+	// ProvisionMethod selects how the init script is run. Empty means the provider default.
+	ProvisionMethod string
+	// OpenPorts are additional inbound firewall rules.
+	OpenPorts []PortRule
+	// WgPortRange, if set, opens a range of UDP ports in the firewall. WireGuard
+	// itself still only listens on WgPort, which must be inside the range.
+	WgPortRange *PortRange
+	// Preflight checks the required permissions before creating any resources.
+	Preflight bool
+	// Progress, if set, is called whenever provisioning enters a new phase.
+	Progress func(phase string)
+	// InterfaceName is the wireguard interface created on the server. Empty means DefaultInterfaceName.
+	InterfaceName string
+	// EgressInterface overrides the interface used for NAT. Empty means the interface of the default route.
+	EgressInterface string
+	// ClientWgIp6 and ServerWgIp6 enable dual stack inside the tunnel if set.
+	ClientWgIp6 net.IP
+	ServerWgIp6 net.IP
+	// ServerPrivateKey pins the wireguard identity of the server across redeploys instead
+	// of generating a key. It is part of the init script and thus the user data.
+	ServerPrivateKey string
+	// InstanceType overrides the default instance (aws) or server (hetzner) type.
+	InstanceType string
+	// InstanceTypeFallbacks are tried in order if InstanceType is sold out (hetzner).
+	InstanceTypeFallbacks []string
+	// AmiId overrides the default image of the aws template, e.g. a custom AMI with wireguard preinstalled.
+	AmiId string
+	// Datacenter places the hetzner server in this datacenter, e.g. fsn1-dc14, instead of
+	// any datacenter of the location Region.
+	Datacenter string
+	// AvailabilityZone places the aws instance in this zone of Region. Empty lets the template choose.
+	AvailabilityZone string
+	// InstanceProfileArn attaches an existing instance profile with ssm permissions to the
+	// aws instance instead of creating a role, for accounts that forbid creating iam roles.
+	InstanceProfileArn string
+	// NoCleanupOnFailure keeps the resources of a failed deployment for debugging.
+	// They have to be removed with DeProvision afterwards.
+	NoCleanupOnFailure bool
+	// OnFailure is the cloudformation OnFailure of the stacks: RETAIN, ROLLBACK or DELETE.
+	// RETAIN and ROLLBACK keep a failed stack for inspection. Empty means DELETE.
+	OnFailure string
+	// InitScriptAttempts is how often the init script is run on the same server before
+	// provisioning fails and the server is removed. 0 means once.
+	InitScriptAttempts int
+	// NoWait returns as soon as the server is created. The init script has to run at
+	// boot (cloud-init) and the server public key is only available via Status later.
+	// aws runs the init script over ssm from Provision and does not support it.
+	NoWait bool
+	// Template replaces the embedded cloudformation template of the instance (aws). It has to
+	// declare the WgPort parameter and the InstanceId and ServerIp outputs.
+	Template string
+	// StackParameters are passed to the cloudformation stack of the instance (aws) in addition
+	// to the parameters derived from the other arguments, which they can not override.
+	StackParameters map[string]string
+	// Peers are additional clients besides ClientPublicKey. Each one may only use its own tunnel address.
+	Peers []Peer
+	// SkipBootstrap assumes the bootstrap of the account (aws) exists instead of creating it.
+	SkipBootstrap bool
+	// ForceBootstrap updates an existing bootstrap (aws) that is older than required
+	// instead of failing.
+	ForceBootstrap bool
+	// Lifecycle is LifecycleEphemeral or LifecyclePersistent, stored in the LifecycleTag.
+	// Empty means persistent.
+	Lifecycle string
+	// Tags are added to all cloud resources, as cloudformation tags (aws) or labels (hetzner).
+	Tags map[string]string
+	// Mtu of the server interface, between MinMtu and MaxMtu. 0 leaves it to wg-quick.
+	Mtu int
+	// VolumeSize in GB of a data volume attached to the server and mounted at
+	// VolumeMountPath, as an ebs volume (aws) or a volume (hetzner). 0 means none.
+	VolumeSize int
+}
+
+// MinMtu and MaxMtu bound the mtu of the wireguard interfaces. Ipv6 requires at least
+// 1280 and 1500 is the mtu of an ethernet link without the wireguard overhead.
+const (
+	MinMtu = 1280
+	MaxMtu = 1500
+)
+
+// ValidateMtu checks that mtu is 0, which means unset, or within MinMtu and MaxMtu.
+func ValidateMtu(mtu int) error {
+	if mtu != 0 && (mtu < MinMtu || mtu > MaxMtu) {
+		return fmt.Errorf("invalid mtu %d: expected %d to %d", mtu, MinMtu, MaxMtu)
+	}
+	return nil
+}
+
+// resolveInterfaceName returns DefaultInterfaceName if name is empty and name otherwise,
+// which has to be safe to use in the scripts.
+func resolveInterfaceName(name string) (string, error) {
+	if name == "" {
+		return DefaultInterfaceName, nil
+	}
+	if !interfaceNameRegex.MatchString(name) {
+		return "", fmt.Errorf("invalid interface name %q", name)
+	}
+	return name, nil
+}
+
+// ReportProgress calls Progress if it is set.
+func (a ProvisionArguments) ReportProgress(phase string) {
+	if a.Progress != nil {
+		a.Progress(phase)
+	}
+}
+
+// FirewallWgPorts returns the UDP port range that has to be opened for WireGuard.
+func (a ProvisionArguments) FirewallWgPorts() PortRange {
+	if a.WgPortRange != nil {
+		return *a.WgPortRange
+	}
+	return PortRange{Start: a.WgPort, End: a.WgPort}
 }
 
 type DeProvisionArguments struct {
 	Region string
+	// RemoveBootstrap also removes the aws bootstrap stack and its asset bucket. They
+	// are shared by all deployments of the account and region, so this is opt-in.
+	RemoveBootstrap bool
+}
+
+// InstanceArguments identify an already provisioned server.
+type InstanceArguments struct {
+	Region string
+	// InterfaceName is the wireguard interface on the server. Empty means DefaultInterfaceName.
+	InterfaceName string
 }
 
 type Location struct {
-	Latitude  float64 `json:"latitude"`
-	Longitude float64 `json:"longitude"`
-	Country   string  `json:"county"`
-	City      string  `json:"city"`
-	Key       string  `json:"key"`
+	Latitude  float64 `json:"latitude" yaml:"latitude"`
+	Longitude float64 `json:"longitude" yaml:"longitude"`
+	Country   string  `json:"county" yaml:"country"`
+	City      string  `json:"city" yaml:"city"`
+	Key       string  `json:"key" yaml:"key"`
+	// CoordinatesUnknown is set if Latitude and Longitude are not known and therefore 0.
+	CoordinatesUnknown bool `json:"coordinatesUnknown,omitempty" yaml:"coordinatesUnknown,omitempty"`
+	// Provider is the provisioner type, only set when listing the locations of several.
+	Provider string `json:"provider,omitempty" yaml:"provider,omitempty"`
 }
 
 type Provisioner interface {
+	// Name is the provisioner type, e.g. aws or hetzner.
+	Name() string
 	Provision(ctx context.Context, id string, args ProvisionArguments) (ProvisionResult, error)
 	DeProvision(ctx context.Context, id string, args DeProvisionArguments) error
 	Locations(ctx context.Context) ([]Location, error)
+	// Stop powers off the server without deleting it.
+	Stop(ctx context.Context, id string, args InstanceArguments) error
+	// Start powers on a previously stopped server.
+	Start(ctx context.Context, id string, args InstanceArguments) error
+	// Usage reports the traffic of a running server.
+	Usage(ctx context.Context, id string, args InstanceArguments) (UsageReport, error)
+	// Diagnose checks credentials and prerequisites for provisioning in args.Region.
+	Diagnose(ctx context.Context, args InstanceArguments) []CheckResult
+	// Status reports whether the server exists and the init script has finished.
+	Status(ctx context.Context, id string, args InstanceArguments) (StatusReport, error)
+	// Logs fetches whatever the provider still has about the deployment, for post-mortems.
+	Logs(ctx context.Context, id string, args InstanceArguments) ([]LogSection, error)
+	// AddPeer adds a client to the running server and persists it in the wireguard config.
+	AddPeer(ctx context.Context, id string, peer Peer, args InstanceArguments) error
+	// RemovePeer removes the client with publicKey from the running server and its config.
+	RemovePeer(ctx context.Context, id string, publicKey string, args InstanceArguments) error
+	// Bootstrap creates the one-time per account and region resources that deploy needs.
+	Bootstrap(ctx context.Context, args InstanceArguments) error
+	// EstimateCost reports what Provision would create with args and its price.
+	EstimateCost(ctx context.Context, args ProvisionArguments) (CostEstimate, error)
+}
+
+// LogSection is one titled piece of the logs of a deployment.
+type LogSection struct {
+	Title   string
+	Content string
+}
+
+// CostEstimate describes the server Provision would create. Empty fields are unknown.
+type CostEstimate struct {
+	InstanceType string
+	HourlyCost   string
+}
+
+type StatusReport struct {
+	Exists   bool   `json:"exists"`
+	Running  bool   `json:"running"`
+	ServerIP net.IP `json:"serverIp,omitempty"`
+	// Ready is true once the init script has written its output.
+	Ready           bool   `json:"ready"`
+	ServerPublicKey string `json:"serverPublicKey,omitempty"`
+}
+
+// CheckResult is the outcome of a single Diagnose check. Err is nil if the check passed.
+type CheckResult struct {
+	Name string
+	Err  error
+	// Skipped is why the check did not run, e.g. because its option is not set.
+	Skipped string
 }
 
 type RunInitScriptOutput struct {
 	ServerWgPublicKey string `json:"ServerWgPublicKey"`
+	// WgImplementation is either kernel or userspace (wireguard-go).
+	WgImplementation string `json:"WgImplementation"`
+	// EgressInterface is the interface used for NAT.
+	EgressInterface string `json:"EgressInterface"`
+	// Ipv6Egress is routed, nat66 or none.
+	Ipv6Egress string `json:"Ipv6Egress"`
+	// InstallSkipped is true if wireguard was already installed on the image.
+	InstallSkipped bool `json:"InstallSkipped"`
+	// InterfaceName is the wireguard interface created by the script.
+	InterfaceName string `json:"InterfaceName"`
+	// VolumeMountPath is where the data volume was mounted, empty without a volume.
+	VolumeMountPath string `json:"VolumeMountPath"`
+	// PortListening is true if wireguard listens on WgPort and no host firewall of the
+	// server, like firewalld, blocks it. The cloud firewall is not checked.
+	PortListening bool `json:"PortListening"`
+	// ServerConfig is the wireguard config of the server with the private key redacted.
+	ServerConfig string `json:"ServerConfig"`
+	// FailedStep is the step the script exited at, empty if it succeeded. The server
+	// is left partially configured then, so the provisioners clean it up.
+	FailedStep string `json:"FailedStep"`
 }
 
-func (a ProvisionArguments) RunInitScript(ctx context.Context, runShellFunc func(string) (string, error)) (*RunInitScriptOutput, error) {
-	var outputSeparator = "93b5409013b3265be85973fc8434a05e8f2e31bd9dae057501e704d40a8ac39f"
-	tpl, err := template.New("initScript").Parse(initScript)
+// ShellFunc runs a bash script on the server and returns its stdout. Providers back it
+// with ssh or ssm, the test-init command with docker exec.
+type ShellFunc func(script string) (string, error)
+
+// initScriptRetryDelay is the pause before the init script is run again, e.g. to give
+// an unavailable package mirror time to come back.
+const initScriptRetryDelay = 15 * time.Second
+
+// RunInitScript runs the init script up to InitScriptAttempts times on the same server.
+// Re-running is safe because init.sh is idempotent, every step checks what an earlier
+// run already did. Changes to the script have to keep it that way.
+func (a ProvisionArguments) RunInitScript(ctx context.Context, runShellFunc ShellFunc) (*RunInitScriptOutput, error) {
+	script, err := a.RenderInitScript()
+	if err != nil {
+		return nil, err
+	}
+
+	attempts := max(a.InitScriptAttempts, 1)
+	for attempt := 1; ; attempt++ {
+		var output *RunInitScriptOutput
+		output, err = runInitScriptOnce(script, runShellFunc)
+		if err == nil || attempt >= attempts {
+			return output, err
+		}
+
+		log.Warn("init script failed, running it again", "attempt", attempt, "attempts", attempts, "err", err)
+		select {
+		case <-ctx.Done():
+			return nil, errors.Join(ctx.Err(), err)
+		case <-time.After(initScriptRetryDelay):
+		}
+	}
+}
+
+func runInitScriptOnce(script string, runShellFunc ShellFunc) (*RunInitScriptOutput, error) {
+	stdout, err := runShellFunc(script)
 	if err != nil {
+		log.Error("failed to run init script", "stdout", stdout, "err", err)
+		if strings.Contains(stdout, outputSeparator) {
+			_, stepErr := ParseInitScriptOutput(stdout)
+			return nil, errors.Join(stepErr, err)
+		}
 		return nil, err
 	}
 
+	return ParseInitScriptOutput(stdout)
+}
+
+// RenderInitScript renders the init script template for the given arguments.
+func (a ProvisionArguments) RenderInitScript() (string, error) {
+	if a.EgressInterface != "" && !interfaceNameRegex.MatchString(a.EgressInterface) {
+		return "", fmt.Errorf("invalid egress interface name %q", a.EgressInterface)
+	}
+
+	if a.ServerPrivateKey != "" {
+		err := ValidatePrivateKey(a.ServerPrivateKey)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	interfaceName, err := resolveInterfaceName(a.InterfaceName)
+	if err != nil {
+		return "", err
+	}
+
+	err = a.validatePeers()
+	if err != nil {
+		return "", err
+	}
+
+	err = ValidateMtu(a.Mtu)
+	if err != nil {
+		return "", err
+	}
+
+	if a.VolumeSize < 0 {
+		return "", fmt.Errorf("invalid volume size %d", a.VolumeSize)
+	}
+
+	// one [Peer] section per client and the source addresses to nat
+	var peerSections, natSources []string
+	for _, peer := range a.AllPeers() {
+		if a.ServerWgIp6 == nil {
+			peer.WgIp6 = nil
+		}
+		peerSections = append(peerSections, fmt.Sprintf("[Peer]\nPublicKey = %s\nAllowedIPs = %s\n", peer.PublicKey, peer.AllowedIPs()))
+		natSources = append(natSources, peer.WgIp.String()+"/32")
+	}
+
+	tpl, err := template.New("initScript").Parse(initScript)
+	if err != nil {
+		return "", err
+	}
+
 	var script strings.Builder
 	params := map[string]string{}
 	params["OutputSeparator"] = outputSeparator
+	params["OutputFile"] = InitScriptOutputFile
 	params["WgPort"] = strconv.Itoa(int(a.WgPort))
 	params["ClientWgIp"] = a.ClientWgIp.String()
 	params["ClientPublicKey"] = a.ClientPublicKey
 	params["ServerWgIp"] = a.ServerWgIp.String()
 	params["Region"] = a.Region
 	params["Type"] = a.Type
+	params["EgressInterface"] = a.EgressInterface
+	params["InterfaceName"] = interfaceName
+	params["ServerPrivateKey"] = a.ServerPrivateKey
+	params["PeerSections"] = strings.Join(peerSections, "\n")
+	params["NatSources"] = strings.Join(natSources, " ")
+	if a.Mtu != 0 {
+		params["Mtu"] = strconv.Itoa(a.Mtu)
+	}
+	if a.VolumeSize > 0 {
+		params["VolumeMountPath"] = VolumeMountPath
+	}
+	if a.ClientWgIp6 != nil && a.ServerWgIp6 != nil {
+		params["ClientWgIp6"] = a.ClientWgIp6.String()
+		params["ServerWgIp6"] = a.ServerWgIp6.String()
+	}
 
 	err = tpl.Execute(&script, params)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	stdout, err := runShellFunc(script.String())
-	if err != nil {
-		log.Error("failed to run init script", "stdout", stdout, "err", err)
-		return nil, err
-	}
+	return script.String(), nil
+}
 
+// ParseInitScriptOutput extracts the structured output from the init script stdout.
+func ParseInitScriptOutput(stdout string) (*RunInitScriptOutput, error) {
 	parts := strings.SplitAfter(stdout, outputSeparator)
 	if len(parts) != 2 {
 		log.Error("init script did not return expected output", "stdout", stdout)
@@ -88,7 +421,90 @@ func (a ProvisionArguments) RunInitScript(ctx context.Context, runShellFunc func
 	}
 
 	outputParams := RunInitScriptOutput{}
-	err = json.Unmarshal([]byte(parts[1]), &outputParams)
+	err := json.Unmarshal([]byte(parts[1]), &outputParams)
+	if err != nil {
+		return nil, err
+	}
+
+	if outputParams.FailedStep != "" {
+		return &outputParams, fmt.Errorf("init script failed at step %s", outputParams.FailedStep)
+	}
+
+	// the providers clean up on errors, a server without a usable key must not be reported as deployed
+	err = ValidatePublicKey(outputParams.ServerWgPublicKey)
+	if err != nil {
+		return &outputParams, fmt.Errorf("init script returned an unusable server key: %w", err)
+	}
+
+	log.Debug("init script finished", "egressInterface", outputParams.EgressInterface, "ipv6Egress", outputParams.Ipv6Egress, "installSkipped", outputParams.InstallSkipped)
+
+	if outputParams.WgImplementation == "userspace" {
+		log.Warn("kernel wireguard is not available, using wireguard-go which is slower")
+	}
+
+	if !outputParams.PortListening {
+		log.Warn("wireguard port is not listening or blocked by a host firewall on the server, clients may not connect")
+	}
+
+	return &outputParams, nil
+}
+
+// ReadInitScriptOutput reads InitScriptOutputFile once. It returns nil if the init
+// script has not finished yet.
+func ReadInitScriptOutput(runShellFunc ShellFunc) (*RunInitScriptOutput, error) {
+	stdout, err := runShellFunc("cat " + InitScriptOutputFile + " 2>/dev/null || true")
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.Contains(stdout, outputSeparator) {
+		return nil, nil
+	}
+
+	return ParseInitScriptOutput(stdout)
+}
+
+// WaitForInitScriptOutput polls InitScriptOutputFile until the init script, started
+// out of band (e.g. by cloud-init), has written its output.
+func WaitForInitScriptOutput(ctx context.Context, timeout time.Duration, runShellFunc ShellFunc) (*RunInitScriptOutput, error) {
+	timeoutTime := time.Now().Add(timeout)
+	var lastError error
+
+	for {
+		if time.Now().After(timeoutTime) {
+			return nil, errors.Join(errors.New("timeout waiting for init script output"), lastError)
+		}
+
+		stdout, err := runShellFunc("cat " + InitScriptOutputFile)
+		if err == nil && strings.Contains(stdout, outputSeparator) {
+			return ParseInitScriptOutput(stdout)
+		}
+		if err != nil {
+			lastError = err
+		}
+
+		log.Info("waiting for init script to finish")
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+const maxErrorOutputLength = 2000
+
+// WithOutput wraps err with the tail of the command output, typically stderr, so
+// the user sees why a remote command failed.
+func WithOutput(err error, output string) error {
+	output = strings.TrimSpace(output)
+	if err == nil || output == "" {
+		return err
+	}
+
+	if len(output) > maxErrorOutputLength {
+		output = "..." + output[len(output)-maxErrorOutputLength:]
+	}
 
-	return &outputParams, err
+	return fmt.Errorf("%w: %s", err, output)
 }
@@ -0,0 +1,113 @@
+package provision
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"golang.org/x/net/proxy"
+)
+
+// HttpProxy returns the proxy function for http clients. An empty proxyUrl falls
+// back to HTTPS_PROXY/HTTP_PROXY/NO_PROXY from the environment.
+func HttpProxy(proxyUrl string) (func(*http.Request) (*url.URL, error), error) {
+	if proxyUrl == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	u, err := url.Parse(proxyUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url %q: %w", proxyUrl, err)
+	}
+
+	return http.ProxyURL(u), nil
+}
+
+// DialContext dials addr, through a proxy if one is configured. An empty proxyUrl
+// falls back to ALL_PROXY from the environment. http(s) proxies are used via
+// CONNECT, socks5 proxies natively.
+func DialContext(ctx context.Context, network, addr, proxyUrl string) (net.Conn, error) {
+	if proxyUrl == "" {
+		proxyUrl = os.Getenv("ALL_PROXY")
+	}
+	if proxyUrl == "" {
+		proxyUrl = os.Getenv("all_proxy")
+	}
+
+	var dialer net.Dialer
+	if proxyUrl == "" {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	u, err := url.Parse(proxyUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url %q: %w", proxyUrl, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return dialConnect(ctx, u, addr)
+	case "socks5", "socks5h":
+		socksDialer, err := proxy.FromURL(u, &dialer)
+		if err != nil {
+			return nil, err
+		}
+
+		if contextDialer, ok := socksDialer.(proxy.ContextDialer); ok {
+			return contextDialer.DialContext(ctx, network, addr)
+		}
+		return socksDialer.Dial(network, addr)
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+}
+
+func dialConnect(ctx context.Context, proxyUrl *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyUrl.Host
+	if proxyUrl.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyUrl.Hostname(), "80")
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxyUrl.User != nil {
+		password, _ := proxyUrl.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyUrl.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT to %s failed: %s", addr, resp.Status)
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,79 @@
+package provision
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket allowing rps requests per second with bursts of up
+// to one second worth of requests.
+type RateLimiter struct {
+	mutex  sync.Mutex
+	rps    float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing rps requests per second, 0 or less means
+// unlimited like the MaxRps options of the provisioners.
+func NewRateLimiter(rps float64) *RateLimiter {
+	return &RateLimiter{
+		rps:    rps,
+		tokens: rps,
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until a request may be made or ctx is done.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l.rps <= 0 {
+		return nil
+	}
+
+	l.mutex.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rps
+	if l.tokens > l.rps {
+		l.tokens = l.rps
+	}
+	l.last = now
+
+	// reserve a token, going negative means waiting until it is refilled
+	l.tokens--
+	delay := time.Duration(0)
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rps * float64(time.Second))
+	}
+	l.mutex.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// RateLimitedTransport limits the requests of the wrapped RoundTripper.
+type RateLimitedTransport struct {
+	Limiter   *RateLimiter
+	Transport http.RoundTripper
+}
+
+func (t *RateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	err := t.Limiter.Wait(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	return t.Transport.RoundTrip(req)
+}
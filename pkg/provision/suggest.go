@@ -0,0 +1,40 @@
+package provision
+
+// maxSuggestionDistance is the largest edit distance ClosestMatch still considers a typo.
+const maxSuggestionDistance = 2
+
+// ClosestMatch returns the candidate closest to s by edit distance if it is likely what
+// was meant, "" otherwise.
+func ClosestMatch(s string, candidates []string) string {
+	best, bestDistance := "", maxSuggestionDistance+1
+	for _, candidate := range candidates {
+		distance := levenshtein(s, candidate)
+		if distance < bestDistance {
+			best, bestDistance = candidate, distance
+		}
+	}
+	return best
+}
+
+// levenshtein is the number of inserted, deleted or substituted bytes turning a into b.
+func levenshtein(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
@@ -0,0 +1,59 @@
+package provision
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// ManagedByTag marks every cloud resource created by wg-ondemand.
+	ManagedByTag   = "managed-by"
+	ManagedByValue = "wg-ondemand"
+
+	// LifecycleTag tells apart deployments that may be reaped once their ttl is over
+	// from ones that are never deleted automatically.
+	LifecycleTag        = "lifecycle"
+	LifecycleEphemeral  = "ephemeral"
+	LifecyclePersistent = "persistent"
+)
+
+// IsReservedTag reports whether key is set by wg-ondemand itself.
+func IsReservedTag(key string) bool {
+	return key == ManagedByTag || key == LifecycleTag
+}
+
+// ValidateLifecycle checks that lifecycle is ephemeral, persistent or empty.
+func ValidateLifecycle(lifecycle string) error {
+	switch lifecycle {
+	case "", LifecycleEphemeral, LifecyclePersistent:
+		return nil
+	default:
+		return fmt.Errorf("invalid lifecycle %q, expected %s or %s", lifecycle, LifecycleEphemeral, LifecyclePersistent)
+	}
+}
+
+// ParseTag parses key=value. The value may be empty.
+func ParseTag(s string) (string, string, error) {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return "", "", fmt.Errorf("invalid tag %q: expected key=value", s)
+	}
+
+	return key, value, nil
+}
+
+// ResourceTags returns the user tags merged with the built-in managed-by and lifecycle
+// tags, which can not be overridden. Without a lifecycle the deployment is persistent.
+func (a ProvisionArguments) ResourceTags() map[string]string {
+	tags := make(map[string]string, len(a.Tags)+2)
+	for k, v := range a.Tags {
+		tags[k] = v
+	}
+	tags[ManagedByTag] = ManagedByValue
+	tags[LifecycleTag] = LifecyclePersistent
+	if a.Lifecycle != "" {
+		tags[LifecycleTag] = a.Lifecycle
+	}
+
+	return tags
+}
@@ -0,0 +1,35 @@
+package provision
+
+import (
+	"errors"
+	"sync"
+)
+
+// RunTasks runs tasks with at most concurrency of them at a time, 0 or less runs all
+// at once. Unlike an errgroup it waits for every task and returns all errors joined.
+func RunTasks(concurrency int, tasks []func() error) error {
+	if concurrency <= 0 || concurrency > len(tasks) {
+		concurrency = len(tasks)
+	}
+
+	wg := sync.WaitGroup{}
+	semaphore := make(chan struct{}, concurrency)
+	// every task writes its own slot, so no channel has to be sized to the task count
+	errs := make([]error, len(tasks))
+
+	for i, task := range tasks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			errs[i] = task()
+		}()
+	}
+
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
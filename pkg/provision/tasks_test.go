@@ -0,0 +1,73 @@
+package provision
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunTasks(t *testing.T) {
+	errFirst := errors.New("first")
+	errSecond := errors.New("second")
+
+	var ran atomic.Int32
+	tasks := []func() error{
+		func() error { ran.Add(1); return errFirst },
+		func() error { ran.Add(1); return nil },
+		func() error { ran.Add(1); return errSecond },
+		func() error { ran.Add(1); return nil },
+	}
+
+	err := RunTasks(2, tasks)
+	if got := ran.Load(); got != int32(len(tasks)) {
+		t.Errorf("ran %d tasks, want %d", got, len(tasks))
+	}
+	if !errors.Is(err, errFirst) || !errors.Is(err, errSecond) {
+		t.Errorf("got %v, want both errors joined", err)
+	}
+}
+
+func TestRunTasksNoErrors(t *testing.T) {
+	err := RunTasks(0, []func() error{
+		func() error { return nil },
+		func() error { return nil },
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRunTasksConcurrency(t *testing.T) {
+	for _, concurrency := range []int{1, 2, 3} {
+		var mutex sync.Mutex
+		running, maxRunning := 0, 0
+
+		tasks := make([]func() error, 8)
+		for i := range tasks {
+			tasks[i] = func() error {
+				mutex.Lock()
+				running++
+				maxRunning = max(maxRunning, running)
+				mutex.Unlock()
+
+				// give the other tasks a chance to start while this one runs
+				time.Sleep(10 * time.Millisecond)
+
+				mutex.Lock()
+				running--
+				mutex.Unlock()
+				return nil
+			}
+		}
+
+		err := RunTasks(concurrency, tasks)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if maxRunning > concurrency {
+			t.Errorf("concurrency %d: %d tasks ran at once", concurrency, maxRunning)
+		}
+	}
+}
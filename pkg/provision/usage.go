@@ -0,0 +1,65 @@
+package provision
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// WgTransferCommand prints the received and sent bytes per peer of the wireguard
+// interface, DefaultInterfaceName if empty.
+func WgTransferCommand(interfaceName string) (string, error) {
+	interfaceName, err := resolveInterfaceName(interfaceName)
+	if err != nil {
+		return "", err
+	}
+
+	return "wg show " + interfaceName + " transfer", nil
+}
+
+type PeerUsage struct {
+	PublicKey string `json:"publicKey"`
+	RxBytes   uint64 `json:"rxBytes"`
+	TxBytes   uint64 `json:"txBytes"`
+}
+
+type UsageReport struct {
+	Peers []PeerUsage `json:"peers"`
+	// ProviderIngoingBytes and ProviderOutgoingBytes are the traffic metrics of the
+	// provider, nil if the provider does not expose them.
+	ProviderIngoingBytes  *uint64 `json:"providerIngoingBytes,omitempty"`
+	ProviderOutgoingBytes *uint64 `json:"providerOutgoingBytes,omitempty"`
+}
+
+// ParseWgTransfer parses the output of WgTransferCommand.
+func ParseWgTransfer(stdout string) ([]PeerUsage, error) {
+	var peers []PeerUsage
+	for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected wg transfer line: %q", line)
+		}
+
+		rx, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		tx, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		peers = append(peers, PeerUsage{
+			PublicKey: fields[0],
+			RxBytes:   rx,
+			TxBytes:   tx,
+		})
+	}
+
+	return peers, nil
+}
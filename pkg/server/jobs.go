@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/schidstorm/wg-ondemand/pkg/provision"
+)
+
+type JobStatus string
+
+const (
+	JobStatusRunning   JobStatus = "running"
+	JobStatusSucceeded JobStatus = "succeeded"
+	JobStatusFailed    JobStatus = "failed"
+)
+
+type Job struct {
+	Id         string                     `json:"id"`
+	Kind       string                     `json:"kind"`
+	Status     JobStatus                  `json:"status"`
+	Phase      string                     `json:"phase,omitempty"`
+	Result     *provision.ProvisionResult `json:"result,omitempty"`
+	Error      string                     `json:"error,omitempty"`
+	CreatedAt  time.Time                  `json:"createdAt"`
+	FinishedAt *time.Time                 `json:"finishedAt,omitempty"`
+}
+
+// JobFunc does the work of a job. progress reports the current phase.
+type JobFunc func(ctx context.Context, progress func(phase string)) (*provision.ProvisionResult, error)
+
+// JobManager runs jobs in the background and keeps finished jobs in memory for ttl.
+type JobManager struct {
+	ctx context.Context
+	ttl time.Duration
+
+	mutex   sync.Mutex
+	jobs    map[string]*Job
+	running sync.WaitGroup
+}
+
+// NewJobManager creates a JobManager whose jobs are cancelled once ctx is done.
+func NewJobManager(ctx context.Context, ttl time.Duration) *JobManager {
+	return &JobManager{
+		ctx:  ctx,
+		ttl:  ttl,
+		jobs: map[string]*Job{},
+	}
+}
+
+// Start runs f in the background and returns a snapshot of the new job.
+func (m *JobManager) Start(kind string, f JobFunc) Job {
+	job := &Job{
+		Id:        newJobId(),
+		Kind:      kind,
+		Status:    JobStatusRunning,
+		CreatedAt: time.Now(),
+	}
+
+	m.mutex.Lock()
+	m.removeExpired()
+	m.jobs[job.Id] = job
+	snapshot := *job
+	m.mutex.Unlock()
+
+	m.running.Add(1)
+	go func() {
+		defer m.running.Done()
+
+		res, err := f(m.ctx, func(phase string) {
+			m.mutex.Lock()
+			defer m.mutex.Unlock()
+			job.Phase = phase
+		})
+
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+
+		now := time.Now()
+		job.FinishedAt = &now
+		if err != nil {
+			log.Error("Job failed", "job", job.Id, "kind", kind, "err", err)
+			job.Status = JobStatusFailed
+			job.Error = err.Error()
+			return
+		}
+
+		job.Status = JobStatusSucceeded
+		job.Result = res
+	}()
+
+	return snapshot
+}
+
+// Wait blocks until all running jobs have returned, including their cleanup.
+func (m *JobManager) Wait() {
+	m.running.Wait()
+}
+
+// Get returns a snapshot of the job.
+func (m *JobManager) Get(id string) (Job, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.removeExpired()
+
+	job, ok := m.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+
+	return *job, true
+}
+
+// removeExpired drops finished jobs older than ttl. The caller must hold the mutex.
+func (m *JobManager) removeExpired() {
+	for id, job := range m.jobs {
+		if job.FinishedAt != nil && time.Since(*job.FinishedAt) > m.ttl {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+func newJobId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/schidstorm/wg-ondemand/pkg/provision"
+)
+
+type Server struct {
+	// Token is the bearer token clients have to send. Requests are rejected if empty.
+	Token string
+	// NewProvisioner creates a provisioner for a type like aws or hetzner.
+	NewProvisioner func(t string) (provision.Provisioner, error)
+	ServerWgIp     net.IP
+	ClientWgIp     net.IP
+	// JobTTL is how long finished jobs can be polled. Defaults to one hour.
+	JobTTL time.Duration
+
+	// ctx is the context of ListenAndServe, jobs are cancelled with it.
+	ctx      context.Context
+	jobsOnce sync.Once
+	jobs     *JobManager
+}
+
+type DeployRequest struct {
+	Type      string `json:"type"`
+	Region    string `json:"region"`
+	Id        string `json:"id"`
+	PublicKey string `json:"publicKey"`
+	Port      uint16 `json:"port"`
+}
+
+type DeleteRequest struct {
+	Type   string `json:"type"`
+	Region string `json:"region"`
+	Id     string `json:"id"`
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /deploy", s.handleDeploy)
+	mux.HandleFunc("POST /delete", s.handleDelete)
+	mux.HandleFunc("GET /regions", s.handleRegions)
+	mux.HandleFunc("GET /jobs/{id}", s.handleJob)
+
+	return s.authenticate(mux)
+}
+
+// ListenAndServe serves the api on addr until ctx is done. Running jobs are cancelled
+// then and it returns once they have cleaned up.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	if s.Token == "" {
+		return errors.New("a bearer token is required")
+	}
+	s.ctx = ctx
+
+	httpServer := &http.Server{
+		Addr:    addr,
+		Handler: s.Handler(),
+	}
+
+	go func() {
+		<-ctx.Done()
+		httpServer.Shutdown(context.Background())
+	}()
+
+	log.Info("Serving api", "addr", addr)
+	err := httpServer.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		log.Info("Waiting for running jobs to clean up")
+		s.jobManager().Wait()
+		return nil
+	}
+
+	return err
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if s.Token == "" || !found || subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleDeploy(w http.ResponseWriter, r *http.Request) {
+	var req DeployRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Id == "" || req.Region == "" || req.PublicKey == "" {
+		writeError(w, http.StatusBadRequest, errors.New("id, region and publicKey are required"))
+		return
+	}
+
+	err = provision.ValidateId(req.Id)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = provision.ValidatePublicKey(req.PublicKey)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Port == 0 {
+		req.Port = 51820
+	}
+
+	provisioner, err := s.NewProvisioner(req.Type)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	job := s.jobManager().Start("deploy", func(ctx context.Context, progress func(string)) (*provision.ProvisionResult, error) {
+		res, err := provisioner.Provision(ctx, req.Id, provision.ProvisionArguments{
+			ClientPublicKey: req.PublicKey,
+			ClientWgIp:      s.ClientWgIp,
+			ServerWgIp:      s.ServerWgIp,
+			WgPort:          req.Port,
+			Type:            req.Type,
+			Region:          req.Region,
+			Progress:        progress,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &res, nil
+	})
+
+	writeJson(w, http.StatusAccepted, job)
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	var req DeleteRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = provision.ValidateId(req.Id)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	provisioner, err := s.NewProvisioner(req.Type)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	job := s.jobManager().Start("delete", func(ctx context.Context, progress func(string)) (*provision.ProvisionResult, error) {
+		return nil, provisioner.DeProvision(ctx, req.Id, provision.DeProvisionArguments{
+			Region: req.Region,
+		})
+	})
+
+	writeJson(w, http.StatusAccepted, job)
+}
+
+func (s *Server) handleRegions(w http.ResponseWriter, r *http.Request) {
+	provisioner, err := s.NewProvisioner(r.URL.Query().Get("type"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	locations, err := provisioner.Locations(r.Context())
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, locations)
+}
+
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.jobManager().Get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("job not found"))
+		return
+	}
+
+	writeJson(w, http.StatusOK, job)
+}
+
+func (s *Server) jobManager() *JobManager {
+	s.jobsOnce.Do(func() {
+		ttl := s.JobTTL
+		if ttl == 0 {
+			ttl = time.Hour
+		}
+		ctx := s.ctx
+		if ctx == nil {
+			// the handler is used without ListenAndServe
+			ctx = context.Background()
+		}
+		s.jobs = NewJobManager(ctx, ttl)
+	})
+
+	return s.jobs
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, map[string]string{"error": err.Error()})
+}